@@ -24,6 +24,14 @@ const (
 	// health assessment result.
 	HealthyCondition string = "Healthy"
 
+	// PolicyViolationCondition represents the fact that
+	// some of the rendered objects violate the policy.
+	PolicyViolationCondition string = "PolicyViolation"
+
+	// ValidatedCondition represents the last recorded
+	// validation result of the rendered objects.
+	ValidatedCondition string = "Validated"
+
 	// ArtifactFailedReason represents the fact that the
 	// source artifact download failed.
 	ArtifactFailedReason string = "ArtifactFailed"
@@ -48,6 +56,26 @@ const (
 	// one of the dependencies is not ready.
 	DependencyNotReadyReason string = "DependencyNotReady"
 
+	// DependencyCycleReason represents the fact that
+	// the object is part of a dependency cycle.
+	DependencyCycleReason string = "DependencyCycle"
+
+	// PolicyViolationReason represents the fact that some
+	// of the rendered objects violate the policy.
+	PolicyViolationReason string = "PolicyViolation"
+
+	// ValidationSucceededReason represents the fact that
+	// the rendered objects passed their validations.
+	ValidationSucceededReason string = "ValidationSucceeded"
+
+	// ValidationFailedReason represents the fact that
+	// some of the rendered objects failed their validations.
+	ValidationFailedReason string = "ValidationFailed"
+
+	// ValidationSchemaFailedReason represents the fact that
+	// some validations were skipped as their schema is unavailable.
+	ValidationSchemaFailedReason string = "ValidationSchemaFailed"
+
 	// ReconciliationSucceededReason represents the fact that
 	// the reconciliation succeeded.
 	ReconciliationSucceededReason string = "ReconciliationSucceeded"
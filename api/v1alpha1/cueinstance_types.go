@@ -20,10 +20,13 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"fmt"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fluxcd/pkg/apis/meta"
 
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -49,15 +52,32 @@ const (
 )
 
 // CueInstanceSpec defines the desired state of CueInstance
+// +kubebuilder:validation:XValidation:rule="has(self.sourceRef) != has(self.inline)",message="exactly one of sourceRef or inline must be set"
 type CueInstanceSpec struct {
 	// The interval at which the instance will be reconciled.
 	// +required
 	Interval metav1.Duration `json:"interval"`
 
 	// A reference to a Flux Source from which an artifact will be downloaded
-	// and the CUE instance built.
-	// +required
-	SourceRef CrossNamespaceSourceReference `json:"sourceRef"`
+	// and the CUE instance built. Required when Inline is not set.
+	// +optional
+	SourceRef *CrossNamespaceSourceReference `json:"sourceRef,omitempty"`
+
+	// Inline CUE files which are written into an empty module root instead
+	// of fetching an artifact from a Flux Source.
+	// +optional
+	Inline []InlineFile `json:"inline,omitempty"`
+
+	// ConfigMaps and Secrets whose keys are written as files into the build
+	// tree on top of the source files.
+	// +optional
+	OverlaysFrom []OverlayReference `json:"overlaysFrom,omitempty"`
+
+	// Files which are overlaid on top of the build tree when loading the CUE
+	// instance, keyed by their path relative to the module root. Files with
+	// a '.cue' extension are loaded as CUE, '.yaml' and '.json' files as data.
+	// +optional
+	Overlays map[string]string `json:"overlays,omitempty"`
 
 	// The module root of the CUE instance.
 	// +optional
@@ -72,26 +92,78 @@ type CueInstanceSpec struct {
 	// +optional
 	Package string `json:"package,omitempty"`
 
+	// Dependencies configures how the dependencies of the CUE module are
+	// resolved.
+	// +optional
+	Dependencies *Dependencies `json:"dependencies,omitempty"`
+
 	// Tags that will be injected into the CUE instance.
 	// +optional
 	Tags []TagVar `json:"tags,omitempty"`
 
 	// TagVars that will be available to the CUE instance.
+	// In addition to the CUE defaults, the controller provides flux_revision,
+	// flux_digest, flux_source_name, cueinstance_name, cueinstance_namespace,
+	// cluster_name and kubernetes_version, which can be overridden here.
 	// +optional
 	TagVars []TagVar `json:"tagVars,omitempty"`
 
-	// The CUE expression(s) to execute.
+	// Values holds structured values which are unified into the CUE instance
+	// at the ValuesPath before the expressions are evaluated.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +optional
+	Values *apiextensionsv1.JSON `json:"values,omitempty"`
+
+	// ValuesFrom holds references to ConfigMap or Secret keys containing
+	// YAML or JSON values which are unified into the CUE instance at the
+	// ValuesPath, together with Values.
+	// +optional
+	ValuesFrom []ValuesReference `json:"valuesFrom,omitempty"`
+
+	// ValuesPath is the CUE path at which Values and ValuesFrom are unified.
+	// +kubebuilder:default:="values"
+	// +optional
+	ValuesPath string `json:"valuesPath,omitempty"`
+
+	// The CUE expression(s) to execute. Expressions containing '*' or '?',
+	// or which are not valid CUE paths, are glob selectors matched segment
+	// by segment against the field labels and list indices of the evaluated
+	// value, e.g. 'apps.*.objects' or 'components.[a-z]*.manifests'.
 	// +optional
 	Exprs []string `json:"expressions,omitempty"`
 
+	// Glob selectors of the values which are excluded from the output of
+	// the expressions, together with any value nested beneath them.
+	// +optional
+	ExcludeExprs []string `json:"excludeExpressions,omitempty"`
+
+	// Extract configures how Kubernetes objects are extracted from the
+	// output of the expressions.
+	// +optional
+	Extract *Extraction `json:"extract,omitempty"`
+
+	// Outputs maps names to CUE paths whose concrete values are exported
+	// into the status after a successful apply.
+	// +optional
+	Outputs map[string]string `json:"outputs,omitempty"`
+
+	// OutputsConfigMap is a ConfigMap in the namespace of the CueInstance,
+	// owned by it, into which the outputs are exported. String values are
+	// written as is, other values as JSON.
+	// +optional
+	OutputsConfigMap *meta.LocalObjectReference `json:"outputsConfigMap,omitempty"`
+
 	// A list of CUE expressions that must be true for the CUE instance to be
 	// reconciled
 	// +optional
 	Gates []GateExpr `json:"gates,omitempty"`
 
 	// Dependencies that must be ready before the CUE instance is reconciled.
+	// A dependency is ready when its Ready condition is true for its current
+	// generation and, if it uses the same source, it has applied the current
+	// revision.
 	// +optional
-	DependsOn []meta.NamespacedObjectReference `json:"dependsOn,omitempty"`
+	DependsOn []DependencyReference `json:"dependsOn,omitempty"`
 
 	// A list of resources to be included in the health assessment.
 	// +optional
@@ -138,16 +210,40 @@ type CueInstanceSpec struct {
 	// +optional
 	Force bool `json:"force,omitempty"`
 
+	// AllowedKinds restricts the kinds of the objects the CueInstance may
+	// manage, in the 'Kind' or 'Kind.group' format, e.g. 'ConfigMap' or
+	// 'Deployment.apps'. Defaults to all kinds.
+	// +optional
+	AllowedKinds []string `json:"allowedKinds,omitempty"`
+
+	// AllowedNamespaces restricts the namespaces of the objects the
+	// CueInstance may manage, and the Namespaces it may manage. When set,
+	// other cluster-scoped objects are not allowed. Defaults to all
+	// namespaces.
+	// +optional
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+
+	// Preflight instructs the controller to server-side dry-run all the
+	// resources before applying any of them, so that a rejected resource
+	// fails the reconciliation before the others are applied.
+	// +kubebuilder:default:=false
+	// +optional
+	Preflight bool `json:"preflight,omitempty"`
+
 	// Wait instructs the controller to check the health of all the reconciled resources.
 	// When enabled, the HealthChecks are ignored. Defaults to false.
 	// +optional
 	Wait bool `json:"wait,omitempty"`
 
-	// TODO(maybe): this could be an array of validations
-	// in which case the policy may need to apply to all resources
-	// would allow for greater flexibility
+	// Validate is a single validation.
+	// Deprecated: use Validations instead.
 	// +optional
 	Validate *Validation `json:"validate,omitempty"`
+
+	// Validations are evaluated against every object extracted from the
+	// CUE instance which matches their selector, before it is applied.
+	// +optional
+	Validations []Validation `json:"validations,omitempty"`
 }
 
 // GateExpr defines a CUE expression that must be true for the CUE instance to be reconciled
@@ -161,26 +257,414 @@ type GateExpr struct {
 	Name string `json:"name"`
 }
 
+// InlineFile is a file embedded in the CueInstance spec.
+type InlineFile struct {
+	// Name of the file relative to the module root, e.g. 'main.cue'.
+	// +kubebuilder:validation:MinLength=1
+	// +required
+	Name string `json:"name"`
+
+	// Content of the file.
+	// +required
+	Content string `json:"content"`
+}
+
+// TagVarType is the type of the value of a tag variable.
+// +kubebuilder:validation:Enum=string;int;number;bool;json
+type TagVarType string
+
+const (
+	// StringTagVarType injects the value as a CUE string.
+	StringTagVarType TagVarType = "string"
+	// IntTagVarType injects the value as a CUE int.
+	IntTagVarType TagVarType = "int"
+	// NumberTagVarType injects the value as a CUE number.
+	NumberTagVarType TagVarType = "number"
+	// BoolTagVarType injects the value as a CUE bool.
+	BoolTagVarType TagVarType = "bool"
+	// JSONTagVarType injects the value as the CUE value of a JSON document,
+	// it is only supported for TagVars.
+	JSONTagVarType TagVarType = "json"
+)
+
 // TagVar is a tag variable with a required name and optional value
+// +kubebuilder:validation:XValidation:rule="!has(self.type) || self.type != 'int' || has(self.valueFrom) || (has(self.value) && self.value.matches('^-?[0-9]+$'))",message="value must be an integer"
+// +kubebuilder:validation:XValidation:rule="!has(self.type) || self.type != 'bool' || has(self.valueFrom) || (has(self.value) && (self.value == 'true' || self.value == 'false'))",message="value must be a boolean"
+// +kubebuilder:validation:XValidation:rule="!(has(self.value) && has(self.valueFrom))",message="at most one of value or valueFrom may be set"
 type TagVar struct {
 	// +required
 	Name string `json:"name"`
 
 	// +optional
 	Value string `json:"value,omitempty"`
+
+	// ValueFrom is the source of the value, it is only supported for TagVars.
+	// +optional
+	ValueFrom *TagVarSource `json:"valueFrom,omitempty"`
+
+	// Type of the value, defaults to 'string'.
+	// +optional
+	Type TagVarType `json:"type,omitempty"`
+}
+
+// TagVarSource is the source of the value of a tag variable.
+type TagVarSource struct {
+	// CueInstanceOutputRef selects an output of a CueInstance.
+	// +required
+	CueInstanceOutputRef *CueInstanceOutputReference `json:"cueInstanceOutputRef"`
+}
+
+// CueInstanceOutputReference selects an output of a CueInstance, which must
+// be listed in the dependsOn of the referring CueInstance.
+type CueInstanceOutputReference struct {
+	// Name of the CueInstance.
+	// +required
+	Name string `json:"name"`
+
+	// Namespace of the CueInstance, defaults to the namespace of the
+	// referring CueInstance.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Output is the name of the output.
+	// +required
+	Output string `json:"output"`
+}
+
+func (in CueInstanceOutputReference) String() string {
+	if in.Namespace != "" {
+		return fmt.Sprintf("%s/%s/%s", in.Namespace, in.Name, in.Output)
+	}
+	return fmt.Sprintf("%s/%s", in.Name, in.Output)
+}
+
+// GetType returns the type of the tag variable value, defaults to 'string'.
+func (in TagVar) GetType() TagVarType {
+	if in.Type == "" {
+		return StringTagVarType
+	}
+	return in.Type
+}
+
+// ValuesReference contains a reference to a key of a ConfigMap or Secret in
+// the namespace of the CueInstance holding YAML or JSON values, or to the
+// outputs of a CueInstance in the same namespace.
+type ValuesReference struct {
+	// Kind of the values referent.
+	// +kubebuilder:validation:Enum=ConfigMap;Secret;CueInstance
+	// +required
+	Kind string `json:"kind"`
+
+	// Name of the values referent.
+	// +required
+	Name string `json:"name"`
+
+	// ValuesKey is the data key where the values can be found,
+	// defaults to 'values.yaml'. For a CueInstance it is the name of an
+	// output, when empty all the outputs are used as a struct.
+	// +optional
+	ValuesKey string `json:"valuesKey,omitempty"`
+
+	// Optional marks this ValuesReference as optional. When set, a not found
+	// error for the values reference is ignored.
+	// +optional
+	Optional bool `json:"optional,omitempty"`
+}
+
+// GetValuesKey returns the defined ValuesKey, or the default ('values.yaml')
+// for a ConfigMap or Secret.
+func (in ValuesReference) GetValuesKey() string {
+	if in.ValuesKey == "" && in.Kind != CueInstanceKind {
+		return "values.yaml"
+	}
+	return in.ValuesKey
+}
+
+func (in ValuesReference) String() string {
+	if in.GetValuesKey() == "" {
+		return fmt.Sprintf("%s/%s", in.Kind, in.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s", in.Kind, in.Name, in.GetValuesKey())
+}
+
+// ExtractionMode is the way Kubernetes objects are extracted from a CUE value.
+// +kubebuilder:validation:Enum=Encode;Recursive
+type ExtractionMode string
+
+const (
+	// EncodeExtractionMode encodes a list as a stream of documents and any
+	// other value as a single document.
+	EncodeExtractionMode ExtractionMode = "Encode"
+	// RecursiveExtractionMode walks nested structs and lists and emits every
+	// value with an apiVersion and a kind as a separate document.
+	RecursiveExtractionMode ExtractionMode = "Recursive"
+)
+
+// Extraction configures how Kubernetes objects are extracted from a CUE value.
+type Extraction struct {
+	// Mode of the extraction, defaults to 'Encode'.
+	// +kubebuilder:default:="Encode"
+	// +optional
+	Mode ExtractionMode `json:"mode,omitempty"`
+
+	// MaxDepth is the maximum nesting depth of the objects found by the
+	// 'Recursive' mode, defaults to 10.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxDepth int `json:"maxDepth,omitempty"`
+}
+
+// GetMode returns the extraction mode, defaults to 'Encode'.
+func (in *Extraction) GetMode() ExtractionMode {
+	if in == nil || in.Mode == "" {
+		return EncodeExtractionMode
+	}
+	return in.Mode
+}
+
+// GetMaxDepth returns the maximum depth of the 'Recursive' mode, defaults
+// to 10.
+func (in *Extraction) GetMaxDepth() int {
+	if in == nil || in.MaxDepth == 0 {
+		return 10
+	}
+	return in.MaxDepth
 }
 
+// DependencyMode is the way the dependencies of a CUE module are resolved.
+// +kubebuilder:validation:Enum=Vendored;Locked;Upgrade
+type DependencyMode string
+
+const (
+	// VendoredDependencyMode does not resolve the dependencies, the imported
+	// packages must be vendored in the cue.mod directory.
+	VendoredDependencyMode DependencyMode = "Vendored"
+	// LockedDependencyMode resolves the dependencies at the versions pinned
+	// in cue.mod/module.sum, and fails if any other version is resolved.
+	LockedDependencyMode DependencyMode = "Locked"
+	// UpgradeDependencyMode resolves the dependencies at their latest
+	// versions.
+	UpgradeDependencyMode DependencyMode = "Upgrade"
+)
+
+// DependencyManagerType is the module system of a CUE module.
+// +kubebuilder:validation:Enum=CueMod;Native
+type DependencyManagerType string
+
+const (
+	// CueModDependencyManager resolves the dependencies of cuemod modules
+	// from Go modules and VCS repositories.
+	CueModDependencyManager DependencyManagerType = "CueMod"
+	// NativeDependencyManager fetches the dependencies of native CUE
+	// modules from OCI registries, at the versions in cue.mod/module.cue.
+	NativeDependencyManager DependencyManagerType = "Native"
+)
+
+// Dependencies configures how the dependencies of a CUE module are resolved.
+type Dependencies struct {
+	// Mode of the resolution, defaults to 'Upgrade'. The 'Native' manager
+	// fetches the versions in cue.mod/module.cue in both the 'Locked' and
+	// 'Upgrade' modes.
+	// +kubebuilder:default:="Upgrade"
+	// +optional
+	Mode DependencyMode `json:"mode,omitempty"`
+
+	// Manager is the module system of the CUE module, defaults to 'CueMod'.
+	// +kubebuilder:default:="CueMod"
+	// +optional
+	Manager DependencyManagerType `json:"manager,omitempty"`
+
+	// Registry configures the OCI registries of the 'Native' manager in the
+	// format of CUE_REGISTRY, e.g. 'registry.example.com/cue' or
+	// 'example.com=registry.example.com,registry.cue.works', defaults to
+	// 'registry.cue.works'.
+	// +optional
+	Registry string `json:"registry,omitempty"`
+
+	// SecretRef is a reference to a Secret holding the credentials of the
+	// registries, either a 'kubernetes.io/dockerconfigjson' Secret or a
+	// Secret with 'username' and 'password' keys.
+	// +optional
+	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
+}
+
+// GetMode returns the resolution mode, defaults to 'Upgrade'.
+func (in *Dependencies) GetMode() DependencyMode {
+	if in == nil || in.Mode == "" {
+		return UpgradeDependencyMode
+	}
+	return in.Mode
+}
+
+// GetManager returns the module system, defaults to 'CueMod'.
+func (in *Dependencies) GetManager() DependencyManagerType {
+	if in == nil || in.Manager == "" {
+		return CueModDependencyManager
+	}
+	return in.Manager
+}
+
+// ModuleVersion is a resolved dependency of a CUE module.
+type ModuleVersion struct {
+	// Module is the path of the module.
+	Module string `json:"module"`
+
+	// Version is the resolved version of the module.
+	Version string `json:"version"`
+}
+
+// ValidationType is the way objects are validated against a schema.
+// +kubebuilder:validation:Enum=cue;yaml;openapi
+type ValidationType string
+
+const (
+	// CueValidationType unifies the object with the CUE schema.
+	CueValidationType ValidationType = "cue"
+	// YamlValidationType validates the YAML encoding of the object against
+	// the CUE schema.
+	YamlValidationType ValidationType = "yaml"
+	// OpenAPIValidationType validates the object against the OpenAPI schema
+	// published by the cluster for its kind.
+	OpenAPIValidationType ValidationType = "openapi"
+)
+
+// Validation defines a schema which the objects extracted from the CUE
+// instance are validated against.
+// +kubebuilder:validation:XValidation:rule="(has(self.type) && self.type == 'openapi') || has(self.schema) || has(self.schemaFrom)",message="schema or schemaFrom is required"
 type Validation struct {
+	// Name of the validation used in reports, defaults to the schema.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Mode defines what happens to objects failing the validation.
+	// +kubebuilder:validation:Enum=Fail;Drop;Audit;Ignore
 	// +kubebuilder:default:="Audit"
 	// +optional
 	Mode ValidationMode `json:"mode,omitempty"`
 
-	// +required
-	Schema string `json:"schema"`
+	// Schema is the CUE path of the schema, within the CUE instance or
+	// within SchemaFrom when set.
+	// +optional
+	Schema string `json:"schema,omitempty"`
+
+	// SchemaFrom is a reference to a ConfigMap or Secret key holding the
+	// CUE source of the schema.
+	// +optional
+	SchemaFrom *SchemaReference `json:"schemaFrom,omitempty"`
 
 	// +kubebuilder:default:="yaml"
 	// +optional
-	Type string `json:"type,omitempty"`
+	Type ValidationType `json:"type,omitempty"`
+
+	// Selector limits the validation to the matching objects, defaults to
+	// all objects.
+	// +optional
+	Selector *ObjectSelector `json:"selector,omitempty"`
+}
+
+// GetName returns the name of the validation, defaults to the schema.
+func (in Validation) GetName() string {
+	switch {
+	case in.Name != "":
+		return in.Name
+	case in.GetSchema() != "":
+		return in.GetSchema()
+	default:
+		return string(in.GetType())
+	}
+}
+
+// GetSchema returns the schema path prefixed by the schema reference, e.g.
+// 'ConfigMap/schemas/schema.cue:#Deployment'.
+func (in Validation) GetSchema() string {
+	switch {
+	case in.SchemaFrom != nil && in.Schema != "":
+		return fmt.Sprintf("%s:%s", in.SchemaFrom.String(), in.Schema)
+	case in.SchemaFrom != nil:
+		return in.SchemaFrom.String()
+	default:
+		return in.Schema
+	}
+}
+
+// GetMode returns the validation mode, defaults to 'Audit'.
+func (in Validation) GetMode() ValidationMode {
+	if in.Mode == "" {
+		return AuditPolicy
+	}
+	return in.Mode
+}
+
+// GetType returns the validation type, defaults to 'yaml'.
+func (in Validation) GetType() ValidationType {
+	if in.Type == "" {
+		return YamlValidationType
+	}
+	return in.Type
+}
+
+// SchemaReference contains a reference to a key of a ConfigMap or Secret in
+// the namespace of the CueInstance holding the CUE source of a schema.
+type SchemaReference struct {
+	// Kind of the schema referent.
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	// +required
+	Kind string `json:"kind"`
+
+	// Name of the schema referent.
+	// +required
+	Name string `json:"name"`
+
+	// Key is the data key where the schema can be found, defaults to
+	// 'schema.cue'.
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// GetKey returns the defined Key, or the default ('schema.cue').
+func (in SchemaReference) GetKey() string {
+	if in.Key == "" {
+		return "schema.cue"
+	}
+	return in.Key
+}
+
+func (in SchemaReference) String() string {
+	return fmt.Sprintf("%s/%s/%s", in.Kind, in.Name, in.GetKey())
+}
+
+// ObjectSelector selects Kubernetes objects by their API version, kind and
+// labels.
+type ObjectSelector struct {
+	// APIVersion of the selected objects, e.g. 'apps/v1'.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Kind of the selected objects, e.g. 'Deployment'.
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// LabelSelector selects objects by their labels.
+	// +optional
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+}
+
+// GetValidations returns the deprecated Validate, if set, followed by the
+// Validations.
+func (in CueInstance) GetValidations() []Validation {
+	if in.Spec.Validate == nil {
+		return in.Spec.Validations
+	}
+	return append([]Validation{*in.Spec.Validate}, in.Spec.Validations...)
+}
+
+// GetValuesPath returns the CUE path at which values are unified, defaults
+// to 'values'.
+func (in CueInstance) GetValuesPath() string {
+	if in.Spec.ValuesPath == "" {
+		return "values"
+	}
+	return in.Spec.ValuesPath
 }
 
 // GetTimeout returns the timeout
@@ -203,9 +687,18 @@ func (in CueInstance) GetRetryInterval() time.Duration {
 	return in.Spec.Interval.Duration
 }
 
-// GetDependsOn returns the list of dependencies across-namespaces.
+// GetDependsOn returns the list of CueInstance dependencies across-namespaces.
 func (in CueInstance) GetDependsOn() []meta.NamespacedObjectReference {
-	return in.Spec.DependsOn
+	var deps []meta.NamespacedObjectReference
+	for _, d := range in.Spec.DependsOn {
+		if d.IsCueInstance() {
+			deps = append(deps, meta.NamespacedObjectReference{
+				Name:      d.Name,
+				Namespace: d.Namespace,
+			})
+		}
+	}
+	return deps
 }
 
 // GetStatusConditions returns a pointer to the Status.Conditions slice.
@@ -320,6 +813,21 @@ type CueInstanceStatus struct {
 	// Inventory contains the list of Kubernetes resource object references that have been successfully applied.
 	// +optional
 	Inventory *ResourceInventory `json:"inventory,omitempty"`
+
+	// Outputs contains the values of the spec outputs at the last applied
+	// revision.
+	// +optional
+	Outputs map[string]apiextensionsv1.JSON `json:"outputs,omitempty"`
+
+	// Validation summarises the validation of the objects at the last
+	// attempted revision.
+	// +optional
+	Validation *ValidationStatus `json:"validation,omitempty"`
+
+	// ResolvedDependencies are the dependencies of the CUE module at the
+	// last successful resolution.
+	// +optional
+	ResolvedDependencies []ModuleVersion `json:"resolvedDependencies,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -347,10 +855,15 @@ func init() {
 	SchemeBuilder.Register(&CueInstance{}, &CueInstanceList{})
 }
 
+// trimString truncates str to at most limit bytes followed by an ellipsis,
+// without splitting a multi-byte character.
 func trimString(str string, limit int) string {
 	if len(str) <= limit {
 		return str
 	}
 
+	for limit > 0 && !utf8.RuneStart(str[limit]) {
+		limit--
+	}
 	return str[0:limit] + "..."
 }
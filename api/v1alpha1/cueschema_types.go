@@ -0,0 +1,120 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	CueSchemaKind = "CueSchema"
+)
+
+// CueSchemaSpec defines a schema which the objects of the matching
+// CueInstances are validated against.
+// +kubebuilder:validation:XValidation:rule="has(self.source) != has(self.sourceRef)",message="exactly one of source or sourceRef is required"
+type CueSchemaSpec struct {
+	// Source is the CUE source of the schema.
+	// +optional
+	Source string `json:"source,omitempty"`
+
+	// SourceRef is a reference to the source holding the CUE files of the
+	// schema, its namespace is required.
+	// +optional
+	SourceRef *SchemaSourceReference `json:"sourceRef,omitempty"`
+
+	// Path to the directory of the CUE files of the schema within the
+	// source, defaults to the root of the source.
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// Schema is the CUE path of the schema within the source, defaults to
+	// the whole source.
+	// +optional
+	Schema string `json:"schema,omitempty"`
+
+	// Type of the validation, 'cue' or 'yaml'.
+	// +kubebuilder:validation:Enum=cue;yaml
+	// +kubebuilder:default:="cue"
+	// +optional
+	Type ValidationType `json:"type,omitempty"`
+
+	// Mode defines what happens to objects failing the schema.
+	// +kubebuilder:validation:Enum=Fail;Drop;Audit;Ignore
+	// +kubebuilder:default:="Audit"
+	// +optional
+	Mode ValidationMode `json:"mode,omitempty"`
+
+	// Selector limits the schema to the matching objects, defaults to all
+	// objects.
+	// +optional
+	Selector *ObjectSelector `json:"selector,omitempty"`
+
+	// NamespaceSelector selects the CueInstances by the labels of their
+	// namespace, defaults to all namespaces.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// InstanceSelector selects the CueInstances by their labels, defaults
+	// to all CueInstances.
+	// +optional
+	InstanceSelector *metav1.LabelSelector `json:"instanceSelector,omitempty"`
+
+	// This flag tells the controller to stop enforcing the schema.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// GetValidation returns the validation of the objects of the matching
+// CueInstances, named after the CueSchema.
+func (in *CueSchema) GetValidation() Validation {
+	t := in.Spec.Type
+	if t == "" {
+		t = CueValidationType
+	}
+	return Validation{
+		Name:     CueSchemaKind + "/" + in.GetName(),
+		Mode:     in.Spec.Mode,
+		Schema:   in.Spec.Schema,
+		Type:     t,
+		Selector: in.Spec.Selector,
+	}
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+
+// CueSchema is the Schema for the cueschemas API
+type CueSchema struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CueSchemaSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// CueSchemaList contains a list of CueSchema
+type CueSchemaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CueSchema `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CueSchema{}, &CueSchemaList{})
+}
@@ -21,6 +21,16 @@ package v1alpha1
 
 import "fmt"
 
+const (
+	// ConfigMapKind is the kind of a ConfigMap which can be used as a source
+	// or an overlay.
+	ConfigMapKind = "ConfigMap"
+
+	// SecretKind is the kind of a Secret which can be used as a source or
+	// an overlay.
+	SecretKind = "Secret"
+)
+
 // CrossNamespaceSourceReference contains enough information to let you locate the
 // typed Kubernetes resource object at cluster level.
 type CrossNamespaceSourceReference struct {
@@ -29,7 +39,7 @@ type CrossNamespaceSourceReference struct {
 	APIVersion string `json:"apiVersion,omitempty"`
 
 	// Kind of the referent.
-	// +kubebuilder:validation:Enum=OCIRepository;GitRepository;Bucket
+	// +kubebuilder:validation:Enum=OCIRepository;GitRepository;Bucket;ConfigMap;Secret
 	// +required
 	Kind string `json:"kind"`
 
@@ -49,3 +59,111 @@ func (s *CrossNamespaceSourceReference) String() string {
 	}
 	return fmt.Sprintf("%s/%s", s.Kind, s.Name)
 }
+
+// SchemaSourceReference contains enough information to locate the source of
+// a cluster-scoped CueSchema, which has no namespace to default to.
+type SchemaSourceReference struct {
+	// API version of the referent.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Kind of the referent.
+	// +kubebuilder:validation:Enum=OCIRepository;GitRepository;Bucket;ConfigMap;Secret
+	// +required
+	Kind string `json:"kind"`
+
+	// Name of the referent.
+	// +required
+	Name string `json:"name"`
+
+	// Namespace of the referent.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Namespace string `json:"namespace"`
+}
+
+func (s *SchemaSourceReference) String() string {
+	return fmt.Sprintf("%s/%s/%s", s.Kind, s.Namespace, s.Name)
+}
+
+// OverlayReference contains enough information to locate a ConfigMap or
+// Secret in the namespace of the CueInstance, whose keys are written as files
+// into the build tree.
+type OverlayReference struct {
+	// Kind of the referent.
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	// +required
+	Kind string `json:"kind"`
+
+	// Name of the referent.
+	// +required
+	Name string `json:"name"`
+
+	// Path relative to the module root at which the files are written,
+	// defaults to the module root.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+func (s *OverlayReference) String() string {
+	return fmt.Sprintf("%s/%s", s.Kind, s.Name)
+}
+
+// DependencyReference contains enough information to locate a CueInstance or
+// any Flux object with a Ready condition, e.g. a Kustomization, HelmRelease
+// or HelmRepository.
+// +kubebuilder:validation:XValidation:rule="has(self.apiVersion) == has(self.kind)",message="apiVersion and kind must be set together"
+type DependencyReference struct {
+	// API version of the referent, defaults to the CueInstance API version.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Kind of the referent, defaults to CueInstance.
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// Name of the referent.
+	// +required
+	Name string `json:"name"`
+
+	// Namespace of the referent, defaults to the namespace of the Kubernetes
+	// resource object that contains the reference.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// ReadyExpr is a CUE expression which must evaluate to true, in addition
+	// to the Ready condition, for the dependency to be ready. The status of
+	// the referent is available as 'status' and its outputs, if any, as
+	// 'outputs', e.g. 'outputs.schemaVersion >= 5'.
+	// +optional
+	ReadyExpr string `json:"readyExpr,omitempty"`
+}
+
+// GetAPIVersion returns the API version of the referent, defaults to the
+// CueInstance API version.
+func (in DependencyReference) GetAPIVersion() string {
+	if in.APIVersion == "" {
+		return GroupVersion.String()
+	}
+	return in.APIVersion
+}
+
+// GetKind returns the kind of the referent, defaults to CueInstance.
+func (in DependencyReference) GetKind() string {
+	if in.Kind == "" {
+		return CueInstanceKind
+	}
+	return in.Kind
+}
+
+// IsCueInstance reports whether the referent is a CueInstance.
+func (in DependencyReference) IsCueInstance() bool {
+	return in.GetAPIVersion() == GroupVersion.String() && in.GetKind() == CueInstanceKind
+}
+
+func (in DependencyReference) String() string {
+	if in.Namespace != "" {
+		return fmt.Sprintf("%s/%s/%s", in.GetKind(), in.Namespace, in.Name)
+	}
+	return fmt.Sprintf("%s/%s", in.GetKind(), in.Name)
+}
@@ -0,0 +1,104 @@
+package v1alpha1
+
+const (
+	// MaxValidationResults is the maximum number of results recorded in
+	// the validation status.
+	MaxValidationResults = 100
+
+	// MaxValidationMessageLength is the maximum length of the message of
+	// a validation result.
+	MaxValidationMessageLength = 1024
+)
+
+// ValidationStatus summarises the outcome of the validations of the objects
+// of a CueInstance at the last attempted revision.
+type ValidationStatus struct {
+	// Checked is the number of objects checked by at least one validation.
+	Checked int `json:"checked"`
+
+	// Dropped is the number of objects which were not applied because they
+	// failed a validation in 'Drop' mode.
+	Dropped int `json:"dropped"`
+
+	// Audited is the number of objects which were applied although they
+	// failed a validation in 'Audit' mode.
+	Audited int `json:"audited"`
+
+	// Results lists the objects which failed a validation, at most
+	// MaxValidationResults of them.
+	// +optional
+	Results []ValidationResult `json:"results,omitempty"`
+
+	// SchemaErrors lists the validations which were skipped because their
+	// schema could not be fetched, compiled or looked up, at most
+	// MaxValidationResults of them.
+	// +optional
+	SchemaErrors []ValidationSchemaError `json:"schemaErrors,omitempty"`
+}
+
+// ValidationResult is the failure of an object to pass a validation.
+type ValidationResult struct {
+	// Object is the ID of the object, in the format
+	// '<kind>/<namespace>/<name>'.
+	Object string `json:"object"`
+
+	// Validation is the name of the failed validation.
+	Validation string `json:"validation"`
+
+	// Schema is the schema path or reference of the failed validation.
+	// +optional
+	Schema string `json:"schema,omitempty"`
+
+	// Mode is the enforcement mode of the failed validation.
+	Mode ValidationMode `json:"mode"`
+
+	// Path is the path of the first invalid value in the object.
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// Message is the validation error, truncated to
+	// MaxValidationMessageLength.
+	Message string `json:"message"`
+}
+
+// ValidationSchemaError is the failure to get the schema of a validation
+// which is not in 'Fail' mode, and was skipped instead of failing the build.
+type ValidationSchemaError struct {
+	// Validation is the name of the skipped validation.
+	Validation string `json:"validation"`
+
+	// Schema is the schema path or reference of the skipped validation.
+	// +optional
+	Schema string `json:"schema,omitempty"`
+
+	// Mode is the enforcement mode of the skipped validation.
+	Mode ValidationMode `json:"mode"`
+
+	// Message is the schema error, truncated to
+	// MaxValidationMessageLength.
+	Message string `json:"message"`
+}
+
+// NewValidationResult returns a ValidationResult with its message
+// truncated to MaxValidationMessageLength.
+func NewValidationResult(object string, v Validation, path, message string) ValidationResult {
+	return ValidationResult{
+		Object:     object,
+		Validation: v.GetName(),
+		Schema:     v.GetSchema(),
+		Mode:       v.GetMode(),
+		Path:       path,
+		Message:    trimString(message, MaxValidationMessageLength),
+	}
+}
+
+// NewValidationSchemaError returns a ValidationSchemaError with its message
+// truncated to MaxValidationMessageLength.
+func NewValidationSchemaError(v Validation, message string) ValidationSchemaError {
+	return ValidationSchemaError{
+		Validation: v.GetName(),
+		Schema:     v.GetSchema(),
+		Mode:       v.GetMode(),
+		Message:    trimString(message, MaxValidationMessageLength),
+	}
+}
@@ -0,0 +1,53 @@
+package v1alpha1
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNewValidationResult_TrimsMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{
+			name:    "short message",
+			message: "invalid value",
+			want:    "invalid value",
+		},
+		{
+			name:    "ascii message at the limit",
+			message: strings.Repeat("a", MaxValidationMessageLength),
+			want:    strings.Repeat("a", MaxValidationMessageLength),
+		},
+		{
+			name:    "ascii message over the limit",
+			message: strings.Repeat("a", MaxValidationMessageLength+1),
+			want:    strings.Repeat("a", MaxValidationMessageLength) + "...",
+		},
+		{
+			name:    "multi-byte character across the limit",
+			message: strings.Repeat("a", MaxValidationMessageLength-1) + "é",
+			want:    strings.Repeat("a", MaxValidationMessageLength-1) + "...",
+		},
+		{
+			name:    "multi-byte characters over the limit",
+			message: strings.Repeat("日本", MaxValidationMessageLength),
+			want:    strings.Repeat("日本", MaxValidationMessageLength/6) + "日" + "...",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewValidationResult("ConfigMap/default/config", Validation{}, "data", tt.message)
+			if !utf8.ValidString(r.Message) {
+				t.Fatalf("message is not valid UTF-8: %q", r.Message)
+			}
+			if r.Message != tt.want {
+				t.Errorf("got message %q, want %q", r.Message, tt.want)
+			}
+		})
+	}
+}
@@ -74,7 +74,7 @@ func TestCueInstanceReconciler_BuildInstance(t *testing.T) {
 					Name: "kubeconfig",
 				},
 			},
-			SourceRef: cueinstancev1a1.CrossNamespaceSourceReference{
+			SourceRef: &cueinstancev1a1.CrossNamespaceSourceReference{
 				Name:      repositoryName.Name,
 				Namespace: repositoryName.Namespace,
 				Kind:      sourcev1.GitRepositoryKind,
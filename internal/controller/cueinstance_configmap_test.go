@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_ConfigMapSource(t *testing.T) {
+	g := NewWithT(t)
+	id := "configmap-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	saName := "sa-" + randStringRunes(5)
+
+	source := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "source",
+			Namespace: id,
+		},
+		Data: map[string]string{
+			"main.cue": fmt.Sprintf(`package main
+
+_name: string
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ServiceAccount"
+	metadata: {
+		name:      _name
+		namespace: %q
+		labels: team: _team
+	}
+}]
+`, id),
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), source)).To(Succeed())
+
+	overlay := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "overlay",
+			Namespace: id,
+		},
+		StringData: map[string]string{
+			"values.cue": fmt.Sprintf("package main\n\n_name: %q\n_team: \"dev\"\n", saName),
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), overlay)).To(Succeed())
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: time.Hour},
+			Exprs: []string{
+				"out",
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: &cueinstancev1a1.CrossNamespaceSourceReference{
+				Name: source.Name,
+				Kind: cueinstancev1a1.ConfigMapKind,
+			},
+			OverlaysFrom: []cueinstancev1a1.OverlayReference{
+				{
+					Name: overlay.Name,
+					Kind: cueinstancev1a1.SecretKind,
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	sa := &corev1.ServiceAccount{}
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      saName,
+		Namespace: id,
+	}, sa)).To(Succeed())
+	g.Expect(sa.Labels).To(HaveKeyWithValue("team", "dev"))
+
+	// Updating the overlay triggers a reconciliation well before the interval.
+	g.Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(overlay), overlay)).To(Succeed())
+	overlay.Data["values.cue"] = []byte(fmt.Sprintf("package main\n\n_name: %q\n_team: \"ops\"\n", saName))
+	g.Expect(k8sClient.Update(context.TODO(), overlay)).To(Succeed())
+
+	g.Eventually(func() bool {
+		if err := k8sClient.Get(context.TODO(), types.NamespacedName{
+			Name:      saName,
+			Namespace: id,
+		}, sa); err != nil {
+			return false
+		}
+		return sa.Labels["team"] == "ops"
+	}, timeout, time.Second).Should(BeTrue())
+}
@@ -10,7 +10,6 @@ import (
 	"time"
 
 	"cuelang.org/go/cue"
-	"cuelang.org/go/cue/ast"
 	"cuelang.org/go/cue/cuecontext"
 	"cuelang.org/go/cue/load"
 	"cuelang.org/go/encoding/yaml"
@@ -26,6 +25,7 @@ import (
 	"github.com/fluxcd/pkg/ssa"
 	"github.com/fluxcd/pkg/tar"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
@@ -33,6 +33,7 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/rest"
 	kuberecorder "k8s.io/client-go/tools/record"
 	"sigs.k8s.io/cli-utils/pkg/kstatus/polling"
 	"sigs.k8s.io/cli-utils/pkg/object"
@@ -62,16 +63,22 @@ type CueInstanceReconciler struct {
 	kuberecorder.EventRecorder
 	runtimeCtrl.Metrics
 
-	artifactFetcher       *fetch.ArchiveFetcher
-	requeueDependency     time.Duration
-	StatusPoller          *polling.StatusPoller
-	PollingOpts           polling.Options
-	ControllerName        string
-	statusManager         string
-	NoCrossNamespaceRefs  bool
-	NoRemoteBases         bool
-	DefaultServiceAccount string
-	KubeConfigOpts        runtimeClient.KubeConfigOptions
+	artifactFetcher         *fetch.ArchiveFetcher
+	requeueDependency       time.Duration
+	StatusPoller            *polling.StatusPoller
+	PollingOpts             polling.Options
+	ControllerName          string
+	statusManager           string
+	NoCrossNamespaceRefs    bool
+	NoRemoteBases           bool
+	NoClusterScopedObjects  bool
+	NoCrossNamespaceObjects bool
+	DefaultServiceAccount   string
+	ClusterName             string
+	KubeConfigOpts          runtimeClient.KubeConfigOptions
+	DependencyCache         *cuemanager.Cache
+	restConfig              *rest.Config
+	openAPICache            *openAPICache
 }
 
 // CueInstanceReconcilerOptions contains options for the CueInstanceReconciler.
@@ -86,6 +93,9 @@ func (r *CueInstanceReconciler) SetupWithManager(ctx context.Context, mgr ctrl.M
 		ociRepositoryIndexKey string = ".metadata.ociRepository"
 		gitRepositoryIndexKey string = ".metadata.gitRepository"
 		bucketIndexKey        string = ".metadata.bucket"
+		configMapIndexKey     string = ".metadata.configMap"
+		secretIndexKey        string = ".metadata.secret"
+		dependsOnIndexKey     string = ".metadata.dependsOn"
 	)
 
 	// Index the CueInstances by the OCIRepository references they (may) point at.
@@ -106,7 +116,27 @@ func (r *CueInstanceReconciler) SetupWithManager(ctx context.Context, mgr ctrl.M
 		return fmt.Errorf("failed setting index fields: %w", err)
 	}
 
+	// Index the CueInstances by the ConfigMap references they (may) point at.
+	if err := mgr.GetCache().IndexField(ctx, &cueinstancev1a1.CueInstance{}, configMapIndexKey,
+		r.indexBy(cueinstancev1a1.ConfigMapKind)); err != nil {
+		return fmt.Errorf("failed setting index fields: %w", err)
+	}
+
+	// Index the CueInstances by the Secret references they (may) point at.
+	if err := mgr.GetCache().IndexField(ctx, &cueinstancev1a1.CueInstance{}, secretIndexKey,
+		r.indexBy(cueinstancev1a1.SecretKind)); err != nil {
+		return fmt.Errorf("failed setting index fields: %w", err)
+	}
+
+	// Index the CueInstances by the CueInstances in their dependsOn.
+	if err := mgr.GetCache().IndexField(ctx, &cueinstancev1a1.CueInstance{}, dependsOnIndexKey,
+		r.indexByDependsOn); err != nil {
+		return fmt.Errorf("failed setting index fields: %w", err)
+	}
+
 	r.requeueDependency = opts.DependencyRequeueInterval
+	r.restConfig = mgr.GetConfig()
+	r.openAPICache = newOpenAPICache()
 	r.statusManager = fmt.Sprintf("gotk-%s", r.ControllerName)
 	r.artifactFetcher = fetch.NewArchiveFetcher(
 		opts.HTTPRetry,
@@ -119,6 +149,16 @@ func (r *CueInstanceReconciler) SetupWithManager(ctx context.Context, mgr ctrl.M
 		For(&cueinstancev1a1.CueInstance{}, builder.WithPredicates(
 			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}),
 		)).
+		Watches(
+			&cueinstancev1a1.CueInstance{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForDependencyReadyOf(dependsOnIndexKey)),
+			builder.WithPredicates(DependencyReadyPredicate{}),
+		).
+		Watches(
+			&cueinstancev1a1.CueSchema{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForCueSchemaChange),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		).
 		Watches(
 			&sourcev1b2.OCIRepository{},
 			handler.EnqueueRequestsFromMapFunc(r.requestsForRevisionChangeOf(ociRepositoryIndexKey)),
@@ -134,6 +174,18 @@ func (r *CueInstanceReconciler) SetupWithManager(ctx context.Context, mgr ctrl.M
 			handler.EnqueueRequestsFromMapFunc(r.requestsForRevisionChangeOf(bucketIndexKey)),
 			builder.WithPredicates(SourceRevisionChangePredicate{}),
 		).
+		Watches(
+			&corev1.ConfigMap{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForResourceVersionChangeOf(configMapIndexKey)),
+			builder.OnlyMetadata,
+			builder.WithPredicates(predicate.ResourceVersionChangedPredicate{}),
+		).
+		Watches(
+			&corev1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForResourceVersionChangeOf(secretIndexKey)),
+			builder.OnlyMetadata,
+			builder.WithPredicates(predicate.ResourceVersionChangedPredicate{}),
+		).
 		WithOptions(controller.Options{
 			RateLimiter: opts.RateLimiter,
 		}).
@@ -225,6 +277,24 @@ func (r *CueInstanceReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{RequeueAfter: obj.GetRetryInterval()}, nil
 	}
 
+	// Stall the reconciliation until the spec changes if the object is part
+	// of a dependency cycle.
+	if len(obj.Spec.DependsOn) > 0 {
+		cycle, err := r.findDependencyCycle(ctx, obj)
+		if err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+		if len(cycle) > 0 {
+			msg := fmt.Sprintf("Dependency cycle detected: %s", strings.Join(cycle, " -> "))
+			conditions.MarkStalled(obj, cueinstancev1a1.DependencyCycleReason, msg)
+			conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.DependencyCycleReason, msg)
+			log.Error(fmt.Errorf("dependency cycle"), msg)
+			r.event(obj, artifactSource.GetArtifact().Revision, eventv1.EventSeverityError, msg, nil)
+			return ctrl.Result{}, nil
+		}
+	}
+	conditions.Delete(obj, meta.StalledCondition)
+
 	// Check dependencies and requeue the reconciliation if the check fails.
 	if len(obj.Spec.DependsOn) > 0 {
 		if err := r.checkDependencies(ctx, obj, artifactSource); err != nil {
@@ -296,7 +366,7 @@ func (r *CueInstanceReconciler) reconcile(
 	defer os.RemoveAll(tmpDir)
 
 	// Download artifact and extract files to the tmp dir.
-	err = r.artifactFetcher.Fetch(src.GetArtifact().URL, src.GetArtifact().Digest, tmpDir)
+	err = r.fetchArtifact(src, tmpDir)
 	if err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.ArtifactFailedReason, err.Error())
 		return err
@@ -315,6 +385,12 @@ func (r *CueInstanceReconciler) reconcile(
 		return err
 	}
 
+	// Write the overlay files on top of the source files.
+	if err := r.fetchOverlays(ctx, obj, moduleRootPath); err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.ArtifactFailedReason, err.Error())
+		return err
+	}
+
 	// check build path exists
 	dirPath, err := securejoin.SecureJoin(moduleRootPath, obj.Spec.Path)
 	if err != nil {
@@ -336,26 +412,18 @@ func (r *CueInstanceReconciler) reconcile(
 		return fmt.Errorf("failed to update status, error: %w", err)
 	}
 
-	// Configure the Kubernetes client for impersonation.
-	impersonation := runtimeClient.NewImpersonator(
-		r.Client,
-		r.StatusPoller,
-		r.PollingOpts,
-		obj.Spec.KubeConfig,
-		r.KubeConfigOpts,
-		r.DefaultServiceAccount,
-		obj.Spec.ServiceAccountName,
-		obj.GetNamespace(),
-	)
-
 	// Create the Kubernetes client that runs under impersonation.
-	kubeClient, statusPoller, err := impersonation.GetClient(ctx)
+	kubeClient, statusPoller, err := r.impersonatedClient(ctx, obj)
 	if err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.ReconciliationFailedReason, err.Error())
 		return fmt.Errorf("failed to build kube client: %w", err)
 	}
 
-	dependencyManager := cuemanager.CueDependencyManager{}
+	dependencyManager, err := r.dependencyManager(ctx, obj)
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.BuildFailedReason, err.Error())
+		return err
+	}
 
 	// get cue dependencies from module.cue file
 
@@ -369,20 +437,50 @@ func (r *CueInstanceReconciler) reconcile(
 		return err
 	}
 
-	// build the cueinstance
-	resources, err := r.build(ctx, revision, moduleRootPath, dirPath, dependencyManager, obj)
+	// get the values to unify into the cueinstance
+	values, err := r.getValues(ctx, obj)
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.BuildFailedReason, err.Error())
+		return err
+	}
+
+	// get the tag variables available to the cueinstance
+	tagVars, err := r.getTagVars(ctx, obj, src)
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.BuildFailedReason, err.Error())
+		return err
+	}
+
+	// Create tmp dir for the CueSchemas.
+	schemasDir, err := MkdirTempAbs("", fmt.Sprintf("cueschemas-%s", obj.Name))
+	if err != nil {
+		err = fmt.Errorf("tmp dir error: %w", err)
+		conditions.MarkFalse(obj, meta.ReadyCondition, sourcev1.DirCreationFailedReason, err.Error())
+		return err
+	}
+
+	defer os.RemoveAll(schemasDir)
+
+	// get the schemas referenced by the validations and the CueSchemas
+	// selecting the cueinstance
+	schemas, err := r.getSchemas(ctx, obj, schemasDir)
 	if err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.BuildFailedReason, err.Error())
 		return err
 	}
 
-	// TODO!!!
 	// ensure the gates are open
-	// err := r.checkGates(ctx, revision, moduleRootPath, dirPath, &cueInstance)
-	// if err != nil {
-	// 	conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.BuildFailedReason, err.Error())
-	// 	return err
-	// }
+	if err := r.checkGates(ctx, revision, moduleRootPath, dirPath, dependencyManager, obj, values, tagVars); err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.BuildFailedReason, err.Error())
+		return err
+	}
+
+	// build the cueinstance
+	resources, outputs, err := r.build(ctx, revision, moduleRootPath, dirPath, dependencyManager, obj, values, tagVars, schemas)
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.BuildFailedReason, err.Error())
+		return err
+	}
 
 	// Convert the build result into Kubernetes unstructured objects.
 	objects, err := ssa.ReadObjects(bytes.NewReader(resources))
@@ -391,6 +489,20 @@ func (r *CueInstanceReconciler) reconcile(
 		return err
 	}
 
+	// Check that the cueinstance may manage the objects.
+	violations, err := r.checkPolicy(obj, kubeClient, objects)
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.ReconciliationFailedReason, err.Error())
+		return err
+	}
+	if len(violations) > 0 {
+		err := fmt.Errorf("%d objects violate the policy: %s", len(violations), strings.Join(violations, ", "))
+		conditions.MarkTrue(obj, cueinstancev1a1.PolicyViolationCondition, cueinstancev1a1.PolicyViolationReason, err.Error())
+		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.PolicyViolationReason, err.Error())
+		return err
+	}
+	conditions.Delete(obj, cueinstancev1a1.PolicyViolationCondition)
+
 	// Create the server-side apply manager.
 	resourceManager := ssa.NewResourceManager(kubeClient, statusPoller, ssa.Owner{
 		Field: r.ControllerName,
@@ -405,6 +517,15 @@ func (r *CueInstanceReconciler) reconcile(
 		return fmt.Errorf("failed to update status, error: %w", err)
 	}
 
+	// Dry-run all resources before applying any of them.
+	if obj.Spec.Preflight {
+		if err := r.preflight(ctx, resourceManager, objects); err != nil {
+			conditions.MarkFalse(obj, cueinstancev1a1.ValidatedCondition, cueinstancev1a1.ValidationFailedReason, err.Error())
+			conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.ValidationFailedReason, err.Error())
+			return err
+		}
+	}
+
 	// Validate and apply resources in stages.
 	drifted, changeSet, err := r.apply(ctx, resourceManager, obj, revision, objects)
 	if err != nil {
@@ -450,6 +571,12 @@ func (r *CueInstanceReconciler) reconcile(
 		return err
 	}
 
+	// Export the outputs of the applied revision.
+	if err := r.exportOutputs(ctx, kubeClient, obj, outputs); err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, cueinstancev1a1.ReconciliationFailedReason, err.Error())
+		return err
+	}
+
 	// Set last applied revision.
 	obj.Status.LastAppliedRevision = revision
 
@@ -495,8 +622,8 @@ func (r *CueInstanceReconciler) finalizeStatus(ctx context.Context,
 	}
 
 	// Remove the Reconciling condition and update the observed generation
-	// if the reconciliation was successful.
-	if conditions.IsTrue(obj, meta.ReadyCondition) {
+	// if the reconciliation was successful or has stalled.
+	if conditions.IsTrue(obj, meta.ReadyCondition) || conditions.IsTrue(obj, meta.StalledCondition) {
 		conditions.Delete(obj, meta.ReconcilingCondition)
 		obj.Status.ObservedGeneration = obj.Generation
 	}
@@ -522,6 +649,8 @@ func (r *CueInstanceReconciler) patch(ctx context.Context,
 	patchOpts := []patch.Option{}
 	ownedConditions := []string{
 		cueinstancev1a1.HealthyCondition,
+		cueinstancev1a1.ValidatedCondition,
+		cueinstancev1a1.PolicyViolationCondition,
 		meta.ReadyCondition,
 		meta.ReconcilingCondition,
 		meta.StalledCondition,
@@ -548,6 +677,13 @@ func (r *CueInstanceReconciler) patch(ctx context.Context,
 
 func (r *CueInstanceReconciler) getSource(ctx context.Context, obj *cueinstancev1a1.CueInstance) (sourcev1.Source, error) {
 	var src sourcev1.Source
+	if len(obj.Spec.Inline) > 0 {
+		return newInlineSource(obj), nil
+	}
+	if obj.Spec.SourceRef == nil {
+		return src, fmt.Errorf("neither sourceRef nor inline is set")
+	}
+
 	sourceNamespace := obj.GetNamespace()
 	if obj.Spec.SourceRef.Namespace != "" {
 		sourceNamespace = obj.Spec.SourceRef.Namespace
@@ -563,7 +699,17 @@ func (r *CueInstanceReconciler) getSource(ctx context.Context, obj *cueinstancev
 				obj.Spec.SourceRef.Kind, namespacedName))
 	}
 
-	switch obj.Spec.SourceRef.Kind {
+	return r.getSourceRef(ctx, obj.Spec.SourceRef.Kind, namespacedName, obj.Spec.Interval.Duration)
+}
+
+// getSourceRef returns the source of the given kind and name. ConfigMaps and
+// Secrets are exposed as sources revisioned every interval.
+func (r *CueInstanceReconciler) getSourceRef(ctx context.Context,
+	kind string,
+	namespacedName types.NamespacedName,
+	interval time.Duration) (sourcev1.Source, error) {
+	var src sourcev1.Source
+	switch kind {
 	case sourcev1b2.OCIRepositoryKind:
 		var repository sourcev1b2.OCIRepository
 		err := r.Client.Get(ctx, namespacedName, &repository)
@@ -594,13 +740,85 @@ func (r *CueInstanceReconciler) getSource(ctx context.Context, obj *cueinstancev
 			return src, fmt.Errorf("unable to get source '%s': %w", namespacedName, err)
 		}
 		src = &bucket
+	case cueinstancev1a1.ConfigMapKind:
+		var cm corev1.ConfigMap
+		err := r.Client.Get(ctx, namespacedName, &cm)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return src, err
+			}
+			return src, fmt.Errorf("unable to get source '%s': %w", namespacedName, err)
+		}
+		src = newConfigMapSource(&cm, interval)
+	case cueinstancev1a1.SecretKind:
+		var secret corev1.Secret
+		err := r.Client.Get(ctx, namespacedName, &secret)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return src, err
+			}
+			return src, fmt.Errorf("unable to get source '%s': %w", namespacedName, err)
+		}
+		src = newSecretSource(&secret, interval)
 	default:
 		return src, fmt.Errorf("source `%s` kind '%s' not supported",
-			obj.Spec.SourceRef.Name, obj.Spec.SourceRef.Kind)
+			namespacedName.Name, kind)
 	}
 	return src, nil
 }
 
+// fetchOverlays writes the keys of the ConfigMaps and Secrets referenced in
+// the overlays of the given CueInstance into the module root.
+func (r *CueInstanceReconciler) fetchOverlays(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	moduleRootPath string) error {
+	for _, o := range obj.Spec.OverlaysFrom {
+		namespacedName := types.NamespacedName{
+			Namespace: obj.GetNamespace(),
+			Name:      o.Name,
+		}
+
+		var src *localSource
+		switch o.Kind {
+		case cueinstancev1a1.ConfigMapKind:
+			var cm corev1.ConfigMap
+			if err := r.Client.Get(ctx, namespacedName, &cm); err != nil {
+				return fmt.Errorf("unable to get overlay '%s': %w", o.String(), err)
+			}
+			src = newConfigMapSource(&cm, obj.Spec.Interval.Duration)
+		case cueinstancev1a1.SecretKind:
+			var secret corev1.Secret
+			if err := r.Client.Get(ctx, namespacedName, &secret); err != nil {
+				return fmt.Errorf("unable to get overlay '%s': %w", o.String(), err)
+			}
+			src = newSecretSource(&secret, obj.Spec.Interval.Duration)
+		default:
+			return fmt.Errorf("overlay `%s` kind '%s' not supported", o.Name, o.Kind)
+		}
+
+		dir, err := securejoin.SecureJoin(moduleRootPath, o.Path)
+		if err != nil {
+			return err
+		}
+		if err := src.writeTo(dir); err != nil {
+			return fmt.Errorf("unable to write overlay '%s': %w", o.String(), err)
+		}
+	}
+	return nil
+}
+
+// fetchArtifact writes the files of the given source into dir, either by
+// downloading and extracting the artifact or, for inline sources, by writing
+// the embedded files.
+func (r *CueInstanceReconciler) fetchArtifact(src sourcev1.Source, dir string) error {
+	switch s := src.(type) {
+	case *localSource:
+		return s.writeTo(dir)
+	default:
+		return r.artifactFetcher.Fetch(src.GetArtifact().URL, src.GetArtifact().Digest, dir)
+	}
+}
+
 func (r *CueInstanceReconciler) checkDependencies(ctx context.Context,
 	obj *cueinstancev1a1.CueInstance,
 	source sourcev1.Source) error {
@@ -612,79 +830,123 @@ func (r *CueInstanceReconciler) checkDependencies(ctx context.Context,
 			Namespace: d.Namespace,
 			Name:      d.Name,
 		}
-		var c cueinstancev1a1.CueInstance
-		err := r.Get(ctx, dName, &c)
+
+		dep := &unstructured.Unstructured{}
+		dep.SetAPIVersion(d.GetAPIVersion())
+		dep.SetKind(d.GetKind())
+		err := r.Get(ctx, dName, dep)
 		if err != nil {
-			return fmt.Errorf("dependency '%s' not found: %w", dName, err)
+			return fmt.Errorf("dependency '%s' not found: %w", d.String(), err)
 		}
 
-		if len(c.Status.Conditions) == 0 || c.Generation != c.Status.ObservedGeneration {
-			return fmt.Errorf("dependency '%s' is not ready", dName)
+		if !isDependencyReady(dep) {
+			return fmt.Errorf("dependency '%s' is not ready", d.String())
 		}
 
-		if !apimeta.IsStatusConditionTrue(c.Status.Conditions, meta.ReadyCondition) {
-			return fmt.Errorf("dependency '%s' is not ready", dName)
+		if d.ReadyExpr != "" {
+			if err := evaluateReadyExpr(dep, d.ReadyExpr); err != nil {
+				return fmt.Errorf("dependency '%s' is not ready: %w", d.String(), err)
+			}
+		}
+
+		// Inline sources are never shared between instances.
+		if obj.Spec.SourceRef == nil {
+			continue
 		}
 
-		srcNamespace := c.Spec.SourceRef.Namespace
+		srcRef, found, _ := unstructured.NestedStringMap(dep.Object, "spec", "sourceRef")
+		if !found {
+			continue
+		}
+		srcNamespace := srcRef["namespace"]
 		if srcNamespace == "" {
-			srcNamespace = c.GetNamespace()
+			srcNamespace = dep.GetNamespace()
 		}
 		dSrcNamespace := obj.Spec.SourceRef.Namespace
 		if dSrcNamespace == "" {
 			dSrcNamespace = obj.GetNamespace()
 		}
 
-		if c.Spec.SourceRef.Name == obj.Spec.SourceRef.Name &&
+		lastAppliedRevision, _, _ := unstructured.NestedString(dep.Object, "status", "lastAppliedRevision")
+		if srcRef["name"] == obj.Spec.SourceRef.Name &&
 			srcNamespace == dSrcNamespace &&
-			c.Spec.SourceRef.Kind == obj.Spec.SourceRef.Kind &&
-			!source.GetArtifact().HasRevision(c.Status.LastAppliedRevision) {
-			return fmt.Errorf("dependency '%s' revision is not up to date", dName)
+			srcRef["kind"] == obj.Spec.SourceRef.Kind &&
+			!source.GetArtifact().HasRevision(lastAppliedRevision) {
+			return fmt.Errorf("dependency '%s' revision is not up to date", d.String())
 		}
 	}
 
 	return nil
 }
 
+// isDependencyReady reports whether the Ready condition of the given object
+// is true for its current generation.
+func isDependencyReady(obj *unstructured.Unstructured) bool {
+	observedGeneration, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	if obj.GetGeneration() != observedGeneration {
+		return false
+	}
+
+	conds, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conds {
+		cond, ok := c.(map[string]interface{})
+		if !ok || cond["type"] != meta.ReadyCondition {
+			continue
+		}
+		return cond["status"] == string(metav1.ConditionTrue)
+	}
+	return false
+}
+
 func (r *CueInstanceReconciler) getCueDependencies(ctx context.Context,
 	revision, moduleRootPath, dirPath string,
 	manager cuemanageri.DependencyManager,
 	obj *cueinstancev1a1.CueInstance) error {
 
 	// Process dependencies for module.
-	if err := manager.Get(ctx, moduleRootPath, dirPath, true, obj); err != nil {
+	resolved, err := manager.Get(ctx, moduleRootPath, dirPath, obj.Spec.Dependencies.GetMode(), obj)
+	if err != nil {
 		msg := fmt.Sprintf("cue dependency manager failed: %s", err)
 		r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
 		return err
 	}
+	obj.Status.ResolvedDependencies = resolved
 
 	return nil
 }
 
-func (r *CueInstanceReconciler) build(ctx context.Context,
-	revision, moduleRootPath, dirPath string,
-	manager cuemanageri.DependencyManager,
-	obj *cueinstancev1a1.CueInstance) ([]byte, error) {
-	cctx := cuecontext.New()
-	log := ctrl.LoggerFrom(ctx)
-
+// loadConfig returns the CUE load configuration for the given CueInstance,
+// with the tags and overlay files from its spec and the given tag variables.
+func (r *CueInstanceReconciler) loadConfig(obj *cueinstancev1a1.CueInstance,
+	moduleRootPath, dirPath string,
+	tagVars map[string]load.TagVar) (*load.Config, error) {
 	tags := make([]string, 0, len(obj.Spec.Tags))
-
 	for _, t := range obj.Spec.Tags {
+		if t.ValueFrom != nil {
+			return nil, fmt.Errorf("tag '%s': valueFrom is only supported for tagVars", t.Name)
+		}
+		// Tags are parsed by CUE according to the type of the @tag
+		// attribute, the declared type is only validated here.
+		if t.GetType() == cueinstancev1a1.JSONTagVarType {
+			return nil, fmt.Errorf("tag '%s': type '%s' is only supported for tagVars", t.Name, t.GetType())
+		}
 		if t.Value != "" {
+			if err := cuemanageri.ValidateTagValue(t); err != nil {
+				return nil, err
+			}
 			tags = append(tags, fmt.Sprintf("%s=%s", t.Name, t.Value))
 		} else {
 			tags = append(tags, t.Name)
 		}
 	}
 
-	tagVars := load.DefaultTagVars()
-	for _, t := range obj.Spec.TagVars {
-		tagVars[t.Name] = load.TagVar{
-			Func: func() (ast.Expr, error) {
-				return ast.NewString(t.Value), nil
-			},
+	overlay := make(map[string]load.Source, len(obj.Spec.Overlays))
+	for name, content := range obj.Spec.Overlays {
+		path, err := securejoin.SecureJoin(moduleRootPath, name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid overlay path '%s': %w", name, err)
 		}
+		overlay[path] = load.FromString(content)
 	}
 
 	cfg := &load.Config{
@@ -693,209 +955,216 @@ func (r *CueInstanceReconciler) build(ctx context.Context,
 		DataFiles:  true, //TODO: this could be configurable
 		Tags:       tags,
 		TagVars:    tagVars,
+		Overlay:    overlay,
 	}
 
 	if obj.Spec.Package != "" {
 		cfg.Package = obj.Spec.Package
 	}
 
+	return cfg, nil
+}
+
+func (r *CueInstanceReconciler) build(ctx context.Context,
+	revision, moduleRootPath, dirPath string,
+	manager cuemanageri.DependencyManager,
+	obj *cueinstancev1a1.CueInstance,
+	values []valuesDocument,
+	tagVars map[string]load.TagVar,
+	schemas *validationSchemas) ([]byte, map[string]apiextensionsv1.JSON, error) {
+	cctx := cuecontext.New()
+
+	cfg, err := r.loadConfig(obj, moduleRootPath, dirPath, tagVars)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	ix := load.Instances([]string{}, cfg)
 	if len(ix) == 0 {
-		return nil, fmt.Errorf("no instances found")
+		return nil, nil, fmt.Errorf("no instances found")
 	}
 
 	inst := ix[0]
 	if inst.Err != nil {
-		return nil, inst.Err
+		return nil, nil, inst.Err
 	}
 
 	value := cctx.BuildInstance(inst)
 	if value.Err() != nil {
-		return nil, value.Err()
+		return nil, nil, value.Err()
 	}
 
-	shouldValidate := obj.Spec.Validate != nil
+	value, err = unifyValues(obj, value, values)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	var result bytes.Buffer
+	outputs, err := evaluateOutputs(obj, value)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if len(obj.Spec.Exprs) > 0 {
-		for _, e := range obj.Spec.Exprs {
-			expr := value.LookupPath(cue.ParsePath(e))
+	validator, err := r.newObjectValidator(ctx, obj, revision, value, schemas, r.newOpenAPISchemas(ctx, obj, cctx))
+	if err != nil {
+		return nil, nil, err
+	}
 
-			data, err := cuemanageri.CueEncodeYAML(expr)
-			if err != nil {
-				return nil, err
-			}
+	var (
+		result  bytes.Buffer
+		objects []cue.Value
+	)
 
-			if shouldValidate && obj.Spec.Validate.Type == "cue" {
-				schema := value.LookupPath(cue.ParsePath(obj.Spec.Validate.Schema))
-				schema.Unify(expr)
-				if err := schema.Unify(expr).Validate(); err != nil {
-					msg := fmt.Sprintf("cue expression validation failed: %s", err)
-					switch obj.Spec.Validate.Mode {
-					case cueinstancev1a1.FailPolicy:
-						r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-						return nil, fmt.Errorf(msg)
-					case cueinstancev1a1.DropPolicy:
-						r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-						continue
-					case cueinstancev1a1.AuditPolicy:
-						r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-						break
-					case cueinstancev1a1.IgnorePolicy:
-						log.Info(msg)
-						break
-					}
-				}
-			}
-			_, err = result.Write(data)
+	if len(obj.Spec.Exprs) > 0 {
+		exprs, err := cuemanageri.SelectExpressions(value, obj.Spec.Exprs, obj.Spec.ExcludeExprs)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, expr := range exprs {
+			objs, err := r.extract(ctx, obj, revision, expr)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
+			objects = append(objects, objs...)
 		}
 
 	} else {
-		data, err := cuemanageri.CueEncodeYAML(value)
+		// split the whole instance into its objects, so that each of them
+		// is validated on its own
+		objs, err := r.extractInstance(ctx, obj, revision, value)
 		if err != nil {
-			return nil, err
-		}
-		valid := false
-
-		if shouldValidate && obj.Spec.Validate.Type == "cue" {
-			schema := value.LookupPath(cue.ParsePath(obj.Spec.Validate.Schema))
-			if err := schema.Unify(value).Validate(); err != nil {
-				msg := fmt.Sprintf("cue validation failed: %s", err)
-				switch obj.Spec.Validate.Mode {
-				case cueinstancev1a1.FailPolicy:
-					r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-					return nil, fmt.Errorf(msg)
-				case cueinstancev1a1.DropPolicy:
-					r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-					valid = false
-				case cueinstancev1a1.AuditPolicy:
-					r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-				case cueinstancev1a1.IgnorePolicy:
-					log.Info(msg)
-				}
-			}
-		}
-
-		if valid {
-			_, err = result.Write(data)
-			if err != nil {
-				return nil, err
-			}
+			return nil, nil, err
 		}
+		objects = objs
 	}
 
 	for _, of := range inst.OrphanedFiles {
 		if of.Encoding == "yaml" {
-			data, err := yaml.Extract(of.Filename, nil)
+			// Source is only set for files provided by the load overlay.
+			data, err := yaml.Extract(of.Filename, of.Source)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			f := cctx.BuildFile(data)
-			switch f.Kind() {
-			case cue.ListKind:
-				l, err := f.List()
-				if err != nil {
-					return nil, err
-				}
-				for l.Next() {
-					data, err := yaml.Encode(l.Value())
-					if err != nil {
-						return nil, err
-					}
-					if shouldValidate && obj.Spec.Validate.Type == "yaml" {
-						schema := value.LookupPath(cue.ParsePath(obj.Spec.Validate.Schema))
-						if err := yaml.Validate(data, schema); err != nil {
-							msg := fmt.Sprintf("yaml validation failed: %s", err)
-							switch obj.Spec.Validate.Mode {
-							case cueinstancev1a1.FailPolicy:
-								r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-								return nil, fmt.Errorf(msg)
-							case cueinstancev1a1.DropPolicy:
-								r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-								continue
-							case cueinstancev1a1.AuditPolicy:
-								r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-								break
-							case cueinstancev1a1.IgnorePolicy:
-								log.Info(msg)
-							}
-						}
-					}
-					result.Write(data)
-					result.Write([]byte("\n---\n"))
-				}
-			case cue.StructKind:
-				data, err := yaml.Encode(f)
-				if err != nil {
-					return nil, err
-				}
-				if shouldValidate && obj.Spec.Validate.Type == "yaml" {
-					schema := value.LookupPath(cue.ParsePath(obj.Spec.Validate.Schema))
-					if err := yaml.Validate(data, schema); err != nil {
-						msg := fmt.Sprintf("yaml validation failed: %s", err)
-						switch obj.Spec.Validate.Mode {
-						case cueinstancev1a1.FailPolicy:
-							r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-							return nil, fmt.Errorf(msg)
-						case cueinstancev1a1.DropPolicy:
-							r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-							continue
-						case cueinstancev1a1.AuditPolicy:
-							r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
-						case cueinstancev1a1.IgnorePolicy:
-							log.Info(msg)
-						}
-					}
-				}
-				result.Write(data)
-				result.Write([]byte("\n---\n"))
+			objs, err := cuemanageri.CueObjects(cctx.BuildFile(data))
+			if err != nil {
+				return nil, nil, err
 			}
+			objects = append(objects, objs...)
 		}
 	}
 
-	return result.Bytes(), nil
-}
+	// validate the extracted objects
+	objects, err = validator.validate(ctx, objects)
+	obj.Status.Validation = validator.summary()
+	setValidatedCondition(obj)
+	if err != nil {
+		return nil, nil, err
+	}
 
-func (r *CueInstanceReconciler) checkGates(ctx context.Context,
-	revision, moduleRootPath, dirPath string,
-	manager cuemanageri.DependencyManager,
-	obj *cueinstancev1a1.CueInstance) error {
+	data, err := cuemanageri.CueEncodeStream(objects)
+	if err != nil {
+		return nil, nil, err
+	}
+	result.Write(data)
 
-	cctx := cuecontext.New()
-	log := ctrl.LoggerFrom(ctx)
+	return result.Bytes(), outputs, nil
+}
 
-	tags := make([]string, 0, len(obj.Spec.Tags))
-	for _, t := range obj.Spec.Tags {
-		if t.Value != "" {
-			tags = append(tags, fmt.Sprintf("%s=%s", t.Name, t.Value))
-		} else {
-			tags = append(tags, t.Name)
+// extract returns the Kubernetes objects of the given value, according to
+// the extraction mode of the CueInstance, without the objects nested beneath
+// its excluded expressions.
+func (r *CueInstanceReconciler) extract(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	revision string,
+	value cue.Value) ([]cue.Value, error) {
+	if obj.Spec.Extract.GetMode() != cueinstancev1a1.RecursiveExtractionMode {
+		objects, err := cuemanageri.CueObjects(value)
+		if err != nil {
+			return nil, err
 		}
+		return cuemanageri.FilterExcluded(objects, obj.Spec.ExcludeExprs)
 	}
 
-	tagVars := load.DefaultTagVars()
-	for _, t := range obj.Spec.TagVars {
-		tagVars[t.Name] = load.TagVar{
-			Func: func() (ast.Expr, error) {
-				return ast.NewString(t.Value), nil
-			},
+	objects, skipped, err := cuemanageri.CueExtractObjects(value, obj.Spec.Extract.GetMaxDepth())
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err = cuemanageri.FilterExcluded(objects, obj.Spec.ExcludeExprs)
+	if err != nil {
+		return nil, err
+	}
+
+	r.reportSkipped(ctx, obj, revision, skipped)
+	return objects, nil
+}
+
+// encodeInstanceDepth is the depth at which the objects of a whole instance
+// are extracted in 'Encode' mode: the fields of the instance, and the items
+// of the lists found in them.
+const encodeInstanceDepth = 2
+
+// extractInstance returns the Kubernetes objects of a whole instance. In
+// 'Encode' mode these are the instance itself if it is an object, the items
+// of a list, or the objects and lists of objects found in its fields.
+func (r *CueInstanceReconciler) extractInstance(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	revision string,
+	value cue.Value) ([]cue.Value, error) {
+	if obj.Spec.Extract.GetMode() == cueinstancev1a1.RecursiveExtractionMode {
+		return r.extract(ctx, obj, revision, value)
+	}
+
+	objects, skipped, err := cuemanageri.CueExtractObjects(value, encodeInstanceDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	r.reportSkipped(ctx, obj, revision, skipped)
+	return objects, nil
+}
+
+// reportSkipped logs and emits an event for the values which were not
+// extracted as objects, listing at most ten of them.
+func (r *CueInstanceReconciler) reportSkipped(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	revision string,
+	skipped []cuemanageri.SkippedValue) {
+	if len(skipped) == 0 {
+		return
+	}
+
+	const maxPaths = 10
+	paths := make([]string, 0, maxPaths+1)
+	for i, s := range skipped {
+		if i == maxPaths {
+			paths = append(paths, fmt.Sprintf("and %d more", len(skipped)-maxPaths))
+			break
 		}
+		paths = append(paths, s.String())
 	}
+	msg := fmt.Sprintf("skipped %d non-object values: %s", len(skipped), strings.Join(paths, ", "))
+	ctrl.LoggerFrom(ctx).Info(msg)
+	r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
+}
 
-	cfg := &load.Config{
-		ModuleRoot: moduleRootPath,
-		Dir:        dirPath,
-		DataFiles:  true, //TODO: this could be configurable
-		Tags:       tags,
-		TagVars:    tagVars,
+func (r *CueInstanceReconciler) checkGates(ctx context.Context,
+	revision, moduleRootPath, dirPath string,
+	manager cuemanageri.DependencyManager,
+	obj *cueinstancev1a1.CueInstance,
+	values []valuesDocument,
+	tagVars map[string]load.TagVar) error {
+
+	if len(obj.Spec.Gates) == 0 {
+		return nil
 	}
 
-	if obj.Spec.Package != "" {
-		cfg.Package = obj.Spec.Package
+	cctx := cuecontext.New()
+	log := ctrl.LoggerFrom(ctx)
+
+	cfg, err := r.loadConfig(obj, moduleRootPath, dirPath, tagVars)
+	if err != nil {
+		return err
 	}
 
 	ix := load.Instances([]string{}, cfg)
@@ -910,15 +1179,26 @@ func (r *CueInstanceReconciler) checkGates(ctx context.Context,
 
 	value := cctx.BuildInstance(inst)
 
+	value, err = unifyValues(obj, value, values)
+	if err != nil {
+		return err
+	}
+
 	var errors []error
 
 	for _, g := range obj.Spec.Gates {
 		result := value.LookupPath(cue.ParsePath(g.Expr))
 		valid := result.Validate()
 		open, err := result.Bool()
-		if !open || valid != nil {
+		if valid != nil {
+			err = valid
+		}
+		if err == nil && !open {
+			err = fmt.Errorf("expression '%s' is false", g.Expr)
+		}
+		if err != nil {
 			log.Info("gate check failed", "gate", g.Name, "expr", g.Expr, "result", result, "error", err)
-			errors = append(errors, fmt.Errorf("%s failed: %w", g.Name, err))
+			errors = append(errors, fmt.Errorf("gate '%s' is closed: %w", g.Name, err))
 		}
 	}
 
@@ -1214,7 +1494,7 @@ func (r *CueInstanceReconciler) finalize(ctx context.Context,
 			obj.GetNamespace(),
 		)
 		if impersonation.CanImpersonate(ctx) {
-			kubeClient, _, err := impersonation.GetClient(ctx)
+			kubeClient, _, err := r.impersonatedClient(ctx, obj)
 			if err != nil {
 				return ctrl.Result{}, err
 			}
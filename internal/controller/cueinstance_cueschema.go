@@ -0,0 +1,260 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/build"
+	"cuelang.org/go/cue/load"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// fetchedCueSchema is a CueSchema whose files have been written to disk,
+// or which failed to be fetched in a mode other than 'Fail'.
+type fetchedCueSchema struct {
+	schema cueinstancev1a1.CueSchema
+	root   string
+	dir    string
+	err    error
+}
+
+// getCueSchemas returns the CueSchemas which select the given CueInstance,
+// by its labels and the labels of its namespace.
+func (r *CueInstanceReconciler) getCueSchemas(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance) ([]cueinstancev1a1.CueSchema, error) {
+	var list cueinstancev1a1.CueSchemaList
+	if err := r.List(ctx, &list); err != nil {
+		return nil, fmt.Errorf("unable to list CueSchemas: %w", err)
+	}
+
+	var namespace *corev1.Namespace
+	var selected []cueinstancev1a1.CueSchema
+	for _, s := range list.Items {
+		if s.Spec.Suspend {
+			continue
+		}
+
+		ok, err := matchesLabelSelector(s.Spec.InstanceSelector, obj.GetLabels())
+		if err != nil {
+			return nil, fmt.Errorf("CueSchema '%s': invalid instance selector: %w", s.Name, err)
+		}
+		if !ok {
+			continue
+		}
+
+		if s.Spec.NamespaceSelector != nil {
+			if namespace == nil {
+				namespace = &corev1.Namespace{}
+				if err := r.Get(ctx, types.NamespacedName{Name: obj.GetNamespace()}, namespace); err != nil {
+					return nil, fmt.Errorf("unable to get namespace '%s': %w", obj.GetNamespace(), err)
+				}
+			}
+			ok, err := matchesLabelSelector(s.Spec.NamespaceSelector, namespace.GetLabels())
+			if err != nil {
+				return nil, fmt.Errorf("CueSchema '%s': invalid namespace selector: %w", s.Name, err)
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		selected = append(selected, s)
+	}
+	return selected, nil
+}
+
+// fetchCueSchemas writes the files of the given CueSchemas into dir, one
+// directory per CueSchema. A CueSchema which fails to be fetched fails the
+// build in 'Fail' mode, otherwise the error is kept to skip its validation.
+func (r *CueInstanceReconciler) fetchCueSchemas(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	schemas []cueinstancev1a1.CueSchema,
+	dir string) ([]fetchedCueSchema, error) {
+	fetched := make([]fetchedCueSchema, 0, len(schemas))
+	for _, s := range schemas {
+		fs, err := r.fetchCueSchema(ctx, obj, s, dir)
+		if err != nil {
+			if s.GetValidation().GetMode() == cueinstancev1a1.FailPolicy {
+				return nil, err
+			}
+			fs = fetchedCueSchema{schema: s, err: err}
+		}
+		fetched = append(fetched, fs)
+	}
+	return fetched, nil
+}
+
+func (r *CueInstanceReconciler) fetchCueSchema(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	s cueinstancev1a1.CueSchema,
+	dir string) (fetchedCueSchema, error) {
+	root := filepath.Join(dir, s.Name)
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return fetchedCueSchema{}, err
+	}
+
+	if ref := s.Spec.SourceRef; ref != nil {
+		namespacedName := types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+		src, err := r.getSourceRef(ctx, ref.Kind, namespacedName, obj.Spec.Interval.Duration)
+		if err != nil {
+			return fetchedCueSchema{}, fmt.Errorf("CueSchema '%s': %w", s.Name, err)
+		}
+		if src.GetArtifact() == nil {
+			return fetchedCueSchema{}, fmt.Errorf("CueSchema '%s': source '%s' is not ready, artifact not found", s.Name, ref.String())
+		}
+		if err := r.fetchArtifact(src, root); err != nil {
+			return fetchedCueSchema{}, fmt.Errorf("CueSchema '%s': %w", s.Name, err)
+		}
+	} else {
+		if err := os.WriteFile(filepath.Join(root, "schema.cue"), []byte(s.Spec.Source), 0o600); err != nil {
+			return fetchedCueSchema{}, err
+		}
+	}
+
+	schemaDir, err := securejoin.SecureJoin(root, s.Spec.Path)
+	if err != nil {
+		return fetchedCueSchema{}, fmt.Errorf("CueSchema '%s': %w", s.Name, err)
+	}
+
+	return fetchedCueSchema{
+		schema: s,
+		root:   root,
+		dir:    schemaDir,
+	}, nil
+}
+
+// compile returns the validation of the CueSchema, with its schema looked
+// up in the CueSchema files built in the given context.
+func (s fetchedCueSchema) compile(cctx *cue.Context) (compiledValidation, error) {
+	if s.err != nil {
+		return compiledValidation{}, s.err
+	}
+
+	validation := s.schema.GetValidation()
+	root, err := s.build(cctx)
+	if err != nil {
+		return compiledValidation{}, err
+	}
+
+	schema, err := lookupSchema(validation, root)
+	if err != nil {
+		return compiledValidation{}, err
+	}
+
+	selector, err := objectLabelSelector(validation)
+	if err != nil {
+		return compiledValidation{}, err
+	}
+
+	return compiledValidation{
+		Validation: validation,
+		schema:     schema,
+		selector:   selector,
+	}, nil
+}
+
+// build returns the value of the CueSchema files in the given context. The
+// files must belong to a single package, or have no package clause.
+func (s fetchedCueSchema) build(cctx *cue.Context) (cue.Value, error) {
+	ix := load.Instances([]string{}, &load.Config{
+		ModuleRoot: s.root,
+		Dir:        s.dir,
+		Package:    "*",
+	})
+
+	var inst *build.Instance
+	for _, i := range ix {
+		if i.Err != nil {
+			return cue.Value{}, fmt.Errorf("CueSchema '%s': %w", s.schema.Name, i.Err)
+		}
+		if len(i.Files) == 0 {
+			continue
+		}
+		if inst != nil {
+			return cue.Value{}, fmt.Errorf("CueSchema '%s': found packages '%s' and '%s'",
+				s.schema.Name, inst.PkgName, i.PkgName)
+		}
+		inst = i
+	}
+	if inst == nil {
+		return cue.Value{}, fmt.Errorf("CueSchema '%s': no instances found", s.schema.Name)
+	}
+
+	value := cctx.BuildInstance(inst)
+	if value.Err() != nil {
+		return cue.Value{}, fmt.Errorf("CueSchema '%s': %w", s.schema.Name, value.Err())
+	}
+	return value, nil
+}
+
+// requestsForCueSchemaChange returns the CueInstances selected by a
+// CueSchema.
+func (r *CueInstanceReconciler) requestsForCueSchemaChange(ctx context.Context, o client.Object) []reconcile.Request {
+	log := ctrl.LoggerFrom(ctx)
+
+	s, ok := o.(*cueinstancev1a1.CueSchema)
+	if !ok {
+		log.Error(fmt.Errorf("expected a CueSchema, got %T", o), "failed to get CueInstances for CueSchema change")
+		return nil
+	}
+
+	var list cueinstancev1a1.CueInstanceList
+	if err := r.List(ctx, &list); err != nil {
+		log.Error(err, "failed to list objects for CueSchema change")
+		return nil
+	}
+
+	namespaces := map[string]bool{}
+	if s.Spec.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(s.Spec.NamespaceSelector)
+		if err != nil {
+			log.Error(err, "invalid namespace selector", "cueschema", s.Name)
+			return nil
+		}
+		var nsList corev1.NamespaceList
+		if err := r.List(ctx, &nsList, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			log.Error(err, "failed to list namespaces for CueSchema change")
+			return nil
+		}
+		for _, ns := range nsList.Items {
+			namespaces[ns.Name] = true
+		}
+	}
+
+	var reqs []reconcile.Request
+	for _, c := range list.Items {
+		if s.Spec.NamespaceSelector != nil && !namespaces[c.Namespace] {
+			continue
+		}
+		if ok, err := matchesLabelSelector(s.Spec.InstanceSelector, c.GetLabels()); err != nil || !ok {
+			continue
+		}
+		reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&c)})
+	}
+	return reqs
+}
+
+// matchesLabelSelector reports whether the labels match the selector, a nil
+// selector matches everything.
+func matchesLabelSelector(selector *metav1.LabelSelector, l map[string]string) (bool, error) {
+	if selector == nil {
+		return true, nil
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false, err
+	}
+	return s.Matches(labels.Set(l)), nil
+}
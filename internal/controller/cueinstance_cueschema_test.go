@@ -0,0 +1,212 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_CueSchema(t *testing.T) {
+	g := NewWithT(t)
+	id := "cueschema-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueSchema := &cueinstancev1a1.CueSchema{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: id,
+		},
+		Spec: cueinstancev1a1.CueSchemaSpec{
+			Source: `#Team: "frontend" | "backend"
+metadata: labels: team: #Team`,
+			Mode: cueinstancev1a1.DropPolicy,
+			Selector: &cueinstancev1a1.ObjectSelector{
+				Kind: "ConfigMap",
+			},
+			InstanceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"policy": id,
+				},
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), cueSchema)).To(Succeed())
+	defer k8sClient.Delete(context.TODO(), cueSchema)
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+			Labels: map[string]string{
+				"policy": id,
+			},
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+owned: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "owned"
+		namespace: %[1]q
+		labels: team: "frontend"
+	}
+}
+
+orphan: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "orphan"
+		namespace: %[1]q
+	}
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(obj.Status.Validation).NotTo(BeNil())
+	g.Expect(obj.Status.Validation.Results).To(HaveLen(1))
+	g.Expect(obj.Status.Validation.Results[0].Validation).To(Equal("CueSchema/" + id))
+
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "owned",
+		Namespace: id,
+	}, &corev1.ConfigMap{})).To(Succeed())
+
+	err = k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "orphan",
+		Namespace: id,
+	}, &corev1.ConfigMap{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestCueInstanceReconciler_CueSchemaUnavailable(t *testing.T) {
+	g := NewWithT(t)
+	id := "cueschema-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	// The source of the CueSchema does not exist.
+	cueSchema := &cueinstancev1a1.CueSchema{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: id,
+		},
+		Spec: cueinstancev1a1.CueSchemaSpec{
+			SourceRef: &cueinstancev1a1.SchemaSourceReference{
+				Kind:      sourcev1.GitRepositoryKind,
+				Name:      "missing",
+				Namespace: id,
+			},
+			Mode: cueinstancev1a1.AuditPolicy,
+			InstanceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"policy": id,
+				},
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), cueSchema)).To(Succeed())
+	defer k8sClient.Delete(context.TODO(), cueSchema)
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "inst-" + randStringRunes(5),
+			Namespace: id,
+			Labels: map[string]string{
+				"policy": id,
+			},
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+config: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "config"
+		namespace: %q
+	}
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	// In 'Audit' mode the CueSchema is skipped and the objects applied.
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(obj.Status.Validation).NotTo(BeNil())
+	g.Expect(obj.Status.Validation.SchemaErrors).To(HaveLen(1))
+	g.Expect(obj.Status.Validation.SchemaErrors[0].Validation).To(Equal("CueSchema/" + id))
+	g.Expect(obj.Status.Validation.SchemaErrors[0].Mode).To(Equal(cueinstancev1a1.AuditPolicy))
+	g.Expect(obj.Status.Validation.SchemaErrors[0].Message).To(ContainSubstring("CueSchema '%s'", id))
+	g.Expect(conditions.GetReason(&obj, cueinstancev1a1.ValidatedCondition)).
+		To(Equal(cueinstancev1a1.ValidationSchemaFailedReason))
+
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "config",
+		Namespace: id,
+	}, &corev1.ConfigMap{})).To(Succeed())
+}
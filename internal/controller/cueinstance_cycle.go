@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"context"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// findDependencyCycle walks the CueInstances in the dependsOn graph of the
+// given CueInstance and returns the path of a cycle through it, e.g.
+// [ns/a ns/b ns/a], or nil if there is none. Missing dependencies are
+// ignored, they are reported by checkDependencies.
+func (r *CueInstanceReconciler) findDependencyCycle(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance) ([]string, error) {
+	start := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	visited := map[types.NamespacedName]bool{}
+
+	var path []string
+	var visit func(c *cueinstancev1a1.CueInstance) (bool, error)
+	visit = func(c *cueinstancev1a1.CueInstance) (bool, error) {
+		key := types.NamespacedName{Namespace: c.GetNamespace(), Name: c.GetName()}
+		path = append(path, key.String())
+
+		for _, d := range c.GetDependsOn() {
+			dName := types.NamespacedName{Namespace: d.Namespace, Name: d.Name}
+			if dName.Namespace == "" {
+				dName.Namespace = c.GetNamespace()
+			}
+
+			if dName == start {
+				path = append(path, dName.String())
+				return true, nil
+			}
+			if visited[dName] {
+				continue
+			}
+			visited[dName] = true
+
+			var dep cueinstancev1a1.CueInstance
+			if err := r.Get(ctx, dName, &dep); err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return false, err
+			}
+
+			found, err := visit(&dep)
+			if err != nil || found {
+				return found, err
+			}
+		}
+
+		path = path[:len(path)-1]
+		return false, nil
+	}
+
+	found, err := visit(obj)
+	if err != nil || !found {
+		return nil, err
+	}
+	return path, nil
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_DependencyCycle(t *testing.T) {
+	g := NewWithT(t)
+	id := "cycle-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	newInstance := func(name, dependsOn string) *cueinstancev1a1.CueInstance {
+		return &cueinstancev1a1.CueInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: id,
+			},
+			Spec: cueinstancev1a1.CueInstanceSpec{
+				Interval: metav1.Duration{Duration: reconciliationInterval},
+				Exprs: []string{
+					"out",
+				},
+				DependsOn: []cueinstancev1a1.DependencyReference{
+					{
+						Name: dependsOn,
+					},
+				},
+				Inline: []cueinstancev1a1.InlineFile{
+					{
+						Name: "main.cue",
+						Content: fmt.Sprintf(`package main
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      %q
+		namespace: %q
+	}
+}]
+`, name, id),
+					},
+				},
+				KubeConfig: &meta.KubeConfigReference{
+					SecretRef: meta.SecretKeyReference{
+						Name: "kubeconfig",
+					},
+				},
+			},
+		}
+	}
+
+	a := newInstance("a", "b")
+	b := newInstance("b", "a")
+	g.Expect(k8sClient.Create(context.TODO(), a)).To(Succeed())
+	g.Expect(k8sClient.Create(context.TODO(), b)).To(Succeed())
+
+	for _, tt := range []struct {
+		obj   *cueinstancev1a1.CueInstance
+		cycle string
+	}{
+		{a, fmt.Sprintf("%[1]s/a -> %[1]s/b -> %[1]s/a", id)},
+		{b, fmt.Sprintf("%[1]s/b -> %[1]s/a -> %[1]s/b", id)},
+	} {
+		g.Eventually(func() bool {
+			var obj cueinstancev1a1.CueInstance
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(tt.obj), &obj)
+			return conditions.IsStalled(&obj) &&
+				conditions.GetReason(&obj, meta.StalledCondition) == cueinstancev1a1.DependencyCycleReason &&
+				conditions.GetMessage(&obj, meta.StalledCondition) == "Dependency cycle detected: "+tt.cycle
+		}, timeout, time.Second).Should(BeTrue())
+	}
+
+	// Breaking the cycle resumes the reconciliation of both instances.
+	g.Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(b), b)).To(Succeed())
+	patch := client.MergeFrom(b.DeepCopy())
+	b.Spec.DependsOn = nil
+	g.Expect(k8sClient.Patch(context.TODO(), b, patch)).To(Succeed())
+
+	for _, obj := range []*cueinstancev1a1.CueInstance{a, b} {
+		g.Eventually(func() bool {
+			var o cueinstancev1a1.CueInstance
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(obj), &o)
+			return isReconcileSuccess(&o) && !conditions.IsStalled(&o)
+		}, timeout, time.Second).Should(BeTrue())
+	}
+}
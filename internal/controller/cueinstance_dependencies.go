@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	cuemanageri "github.com/akirill0v/cue-flux-controller/internal/cue"
+	cuemanager "github.com/akirill0v/cue-flux-controller/internal/cue/cuem"
+)
+
+// dependencyManager returns the manager of the module system of the given
+// CueInstance, with the registry credentials of its spec.
+func (r *CueInstanceReconciler) dependencyManager(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance) (cuemanageri.DependencyManager, error) {
+	deps := obj.Spec.Dependencies
+	switch manager := deps.GetManager(); manager {
+	case cueinstancev1a1.CueModDependencyManager:
+		return cuemanager.CueDependencyManager{
+			NoRemoteBases: r.NoRemoteBases,
+			Cache:         r.DependencyCache,
+		}, nil
+	case cueinstancev1a1.NativeDependencyManager:
+		var keychain authn.Keychain
+		if deps.SecretRef != nil {
+			namespacedName := types.NamespacedName{
+				Namespace: obj.GetNamespace(),
+				Name:      deps.SecretRef.Name,
+			}
+			var secret corev1.Secret
+			if err := r.Client.Get(ctx, namespacedName, &secret); err != nil {
+				return nil, fmt.Errorf("unable to read registry secret '%s': %w", namespacedName, err)
+			}
+			var err error
+			if keychain, err = cuemanager.NewRegistryKeychain(secret.Data); err != nil {
+				return nil, fmt.Errorf("invalid registry secret '%s': %w", namespacedName, err)
+			}
+		}
+		return cuemanager.NativeDependencyManager{
+			NoRemoteBases: r.NoRemoteBases,
+			Registry:      deps.Registry,
+			Keychain:      keychain,
+			Cache:         r.DependencyCache,
+		}, nil
+	default:
+		return nil, fmt.Errorf("dependency manager '%s' not supported", manager)
+	}
+}
@@ -0,0 +1,241 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/akirill0v/cue-flux-controller/internal/cue/cuem"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_VendoredDependencies(t *testing.T) {
+	g := NewWithT(t)
+	id := "vendored-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Dependencies: &cueinstancev1a1.Dependencies{
+				Mode: cueinstancev1a1.VendoredDependencyMode,
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "cue.mod/module.cue",
+					Content: `module: "example.com/app"
+
+require: "example.com/lib": "v1.2.0"
+`,
+				},
+				{
+					Name:    "cue.mod/module.sum",
+					Content: "example.com/lib v1.2.0 h1:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=\n",
+				},
+				{
+					Name: "cue.mod/pkg/example.com/lib/lib.cue",
+					Content: `package lib
+
+#ConfigMap: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      string
+		namespace: string
+	}
+}
+`,
+				},
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+import "example.com/lib"
+
+config: lib.#ConfigMap & {
+	metadata: {
+		name:      "config"
+		namespace: %q
+	}
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(obj.Status.ResolvedDependencies).To(Equal([]cueinstancev1a1.ModuleVersion{
+		{Module: "example.com/lib", Version: "v1.2.0"},
+	}))
+
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "config",
+		Namespace: id,
+	}, &corev1.ConfigMap{})).To(Succeed())
+
+	// An import which is not vendored fails the build.
+	patch := client.MergeFrom(obj.DeepCopy())
+	obj.Spec.Inline = append(obj.Spec.Inline, cueinstancev1a1.InlineFile{
+		Name: "extra.cue",
+		Content: `package main
+
+import "example.com/missing"
+
+extra: missing.#Value
+`,
+	})
+	g.Expect(k8sClient.Patch(context.TODO(), &obj, patch)).To(Succeed())
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.GetReason(&obj, meta.ReadyCondition) == cueinstancev1a1.BuildFailedReason
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(conditions.GetMessage(&obj, meta.ReadyCondition)).
+		To(ContainSubstring("package 'example.com/missing' is not vendored"))
+}
+
+func TestCueInstanceReconciler_DependencyCache(t *testing.T) {
+	g := NewWithT(t)
+	id := "dep-cache-" + randStringRunes(5)
+
+	// Seed the cache with a module which cannot be fetched.
+	cache, err := cuem.NewCache(t.TempDir(), 1<<20)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	vendored := t.TempDir()
+	libDir := filepath.Join(vendored, "cue.mod", "pkg", "example.com", "lib")
+	g.Expect(os.MkdirAll(libDir, 0o700)).To(Succeed())
+	g.Expect(os.WriteFile(filepath.Join(libDir, "lib.cue"), []byte(`package lib
+
+#ConfigMap: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      string
+		namespace: string
+	}
+}
+`), 0o600)).To(Succeed())
+
+	lib := cueinstancev1a1.ModuleVersion{Module: "example.com/lib", Version: "v1.2.0"}
+	g.Expect(cache.Store([]cuem.Module{{
+		ModuleVersion: lib,
+		Sum:           "h1:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+	}}, vendored)).To(Succeed())
+
+	err = createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	startTestReconciler(t, id, CueInstanceReconcilerOptions{}, func(r *CueInstanceReconciler) {
+		r.DependencyCache = cache
+	})
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+			Labels: map[string]string{
+				testReconcilerLabel: id,
+			},
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Dependencies: &cueinstancev1a1.Dependencies{
+				Mode: cueinstancev1a1.LockedDependencyMode,
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "cue.mod/module.cue",
+					Content: `module: "example.com/app"
+
+require: "example.com/lib": "v1.2.0"
+`,
+				},
+				{
+					Name:    "cue.mod/module.sum",
+					Content: "example.com/lib v1.2.0 h1:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=\n",
+				},
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+import "example.com/lib"
+
+config: lib.#ConfigMap & {
+	metadata: {
+		name:      "config"
+		namespace: %q
+	}
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(obj.Status.ResolvedDependencies).To(Equal([]cueinstancev1a1.ModuleVersion{lib}))
+
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "config",
+		Namespace: id,
+	}, &corev1.ConfigMap{})).To(Succeed())
+}
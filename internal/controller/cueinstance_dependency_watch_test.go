@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_DependencyWatch(t *testing.T) {
+	g := NewWithT(t)
+	id := "dep-watch-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	// Requeue the dependents well after the test times out, so that they
+	// only become ready when the readiness of a dependency enqueues them.
+	mgr := startTestReconciler(t, id, CueInstanceReconcilerOptions{
+		DependencyRequeueInterval: 10 * time.Minute,
+	}, nil)
+
+	newInstance := func(name string, dependsOn ...string) *cueinstancev1a1.CueInstance {
+		obj := &cueinstancev1a1.CueInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: id,
+				Labels: map[string]string{
+					testReconcilerLabel: id,
+				},
+			},
+			Spec: cueinstancev1a1.CueInstanceSpec{
+				Interval: metav1.Duration{Duration: reconciliationInterval},
+				Exprs: []string{
+					"out",
+				},
+				Inline: []cueinstancev1a1.InlineFile{
+					{
+						Name: "main.cue",
+						Content: fmt.Sprintf(`package main
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      %q
+		namespace: %q
+	}
+}]
+`, name, id),
+					},
+				},
+				KubeConfig: &meta.KubeConfigReference{
+					SecretRef: meta.SecretKeyReference{
+						Name: "kubeconfig",
+					},
+				},
+			},
+		}
+		for _, d := range dependsOn {
+			obj.Spec.DependsOn = append(obj.Spec.DependsOn, cueinstancev1a1.DependencyReference{Name: d})
+		}
+		return obj
+	}
+
+	// Create the stack top down, so that every layer waits for the one below.
+	layers := []*cueinstancev1a1.CueInstance{
+		newInstance("layer-2", "layer-1"),
+		newInstance("layer-1", "layer-0"),
+		newInstance("layer-0"),
+	}
+	for _, obj := range layers {
+		g.Expect(k8sClient.Create(context.TODO(), obj)).To(Succeed())
+	}
+
+	// The dependents of a CueInstance are found through the dependsOn index.
+	g.Eventually(func() []string {
+		var list cueinstancev1a1.CueInstanceList
+		if err := mgr.GetClient().List(context.TODO(), &list, client.MatchingFields{
+			".metadata.dependsOn": id + "/layer-0",
+		}); err != nil {
+			return nil
+		}
+		var names []string
+		for _, item := range list.Items {
+			names = append(names, item.Name)
+		}
+		return names
+	}, timeout, time.Second).Should(ConsistOf("layer-1"))
+
+	for _, obj := range layers {
+		g.Eventually(func() bool {
+			var o cueinstancev1a1.CueInstance
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(obj), &o)
+			return isReconcileSuccess(&o)
+		}, timeout, time.Second).Should(BeTrue())
+	}
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_DependsOnFluxObject(t *testing.T) {
+	g := NewWithT(t)
+	id := "dependson-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	artifactFile := "instance-" + randStringRunes(5)
+	_, err = createArtifact(testServer, "testdata/tagvars", artifactFile)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// The status of the dependency has no observed generation yet.
+	dependencyName := types.NamespacedName{
+		Name:      "dep-" + randStringRunes(5),
+		Namespace: id,
+	}
+	err = applyGitRepository(dependencyName, artifactFile, "main/"+randStringRunes(7))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			DependsOn: []cueinstancev1a1.DependencyReference{
+				{
+					APIVersion: sourcev1.GroupVersion.String(),
+					Kind:       sourcev1.GitRepositoryKind,
+					Name:       dependencyName.Name,
+				},
+			},
+			Exprs: []string{
+				"out",
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "dependent"
+		namespace: %q
+	}
+}]
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.GetReason(&obj, meta.ReadyCondition) == cueinstancev1a1.DependencyNotReadyReason
+	}, timeout, time.Second).Should(BeTrue())
+
+	repo := &sourcev1.GitRepository{}
+	g.Expect(k8sClient.Get(context.TODO(), dependencyName, repo)).To(Succeed())
+	repo.Status.ObservedGeneration = repo.Generation
+	g.Expect(k8sClient.Status().Update(context.TODO(), repo)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_RecursiveExtraction(t *testing.T) {
+	g := NewWithT(t)
+	id := "extract-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"objects",
+			},
+			Extract: &cueinstancev1a1.Extraction{
+				Mode:     cueinstancev1a1.RecursiveExtractionMode,
+				MaxDepth: 3,
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+#ConfigMap: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      string
+		namespace: %q
+	}
+}
+
+objects: {
+	version: "v1"
+	frontend: {
+		config: #ConfigMap & {metadata: name: "frontend"}
+		account: {
+			apiVersion: "v1"
+			kind:       "ServiceAccount"
+			metadata: {
+				name:      "frontend"
+				namespace: %q
+			}
+		}
+	}
+	backend: [#ConfigMap & {metadata: name: "backend"}]
+	deep: a: b: c: #ConfigMap & {metadata: name: "deep"}
+}
+`, id, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	for _, name := range []string{"frontend", "backend"} {
+		cm := &corev1.ConfigMap{}
+		g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+			Name:      name,
+			Namespace: id,
+		}, cm)).To(Succeed())
+	}
+
+	sa := &corev1.ServiceAccount{}
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "frontend",
+		Namespace: id,
+	}, sa)).To(Succeed())
+
+	// Objects nested deeper than the max depth are skipped.
+	err = k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "deep",
+		Namespace: id,
+	}, &corev1.ConfigMap{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta2"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -84,7 +86,7 @@ func TestCueInstanceReconciler_Gates(t *testing.T) {
 					Name: "kubeconfig",
 				},
 			},
-			SourceRef: cueinstancev1a1.CrossNamespaceSourceReference{
+			SourceRef: &cueinstancev1a1.CrossNamespaceSourceReference{
 				Name:      repositoryName.Name,
 				Namespace: repositoryName.Namespace,
 				Kind:      sourcev1.GitRepositoryKind,
@@ -94,15 +96,24 @@ func TestCueInstanceReconciler_Gates(t *testing.T) {
 
 	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
 
+	// The closed gate is reported and nothing is applied.
+	cinst := &cueinstancev1a1.CueInstance{}
+	g.Eventually(func() bool {
+		if err := k8sClient.Get(context.TODO(), cueInstanceKey, cinst); err != nil {
+			return false
+		}
+		ready := apimeta.FindStatusCondition(cinst.Status.Conditions, meta.ReadyCondition)
+		return ready != nil && ready.Status == metav1.ConditionFalse &&
+			ready.Reason == cueinstancev1a1.BuildFailedReason &&
+			strings.Contains(ready.Message, "gate 'deploy' is closed")
+	}, timeout, time.Second).Should(BeTrue())
+
 	cm := &corev1.ConfigMap{}
 	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
 		Name:      tagName,
 		Namespace: deployNamespace,
 	}, cm)).ToNot(Succeed())
 
-	cinst := &cueinstancev1a1.CueInstance{}
-	g.Expect(k8sClient.Get(context.TODO(), cueInstanceKey, cinst)).To(Succeed())
-
 	patch := client.MergeFrom(cinst.DeepCopy())
 
 	cinst.Spec.Tags[0] = cueinstancev1a1.TagVar{
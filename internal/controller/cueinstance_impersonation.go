@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/polling"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	runtimeClient "github.com/fluxcd/pkg/runtime/client"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// impersonatedClient returns the Kubernetes client and status poller used to
+// reconcile the given CueInstance. If the CueInstance targets a remote cluster
+// or a service account, they are built from impersonatedRESTConfig, otherwise
+// the controller's own client is used.
+func (r *CueInstanceReconciler) impersonatedClient(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance) (client.Client, *polling.StatusPoller, error) {
+	if obj.Spec.KubeConfig == nil && r.impersonatedServiceAccount(obj) == "" {
+		return r.Client, r.StatusPoller, nil
+	}
+
+	restConfig, err := r.impersonatedRESTConfig(ctx, obj)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	restMapper, err := runtimeClient.NewDynamicRESTMapper(restConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kubeClient, err := client.New(restConfig, client.Options{
+		Scheme: r.Client.Scheme(),
+		Mapper: restMapper,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return kubeClient, polling.NewStatusPoller(kubeClient, restMapper, r.PollingOpts), nil
+}
+
+// impersonatedRESTConfig returns the REST config of the client that
+// reconciles the given CueInstance: the config of its KubeConfig secret, or
+// the controller's own config, impersonating its service account, if any.
+func (r *CueInstanceReconciler) impersonatedRESTConfig(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance) (*rest.Config, error) {
+	var restConfig *rest.Config
+	if obj.Spec.KubeConfig != nil {
+		kubeConfig, err := r.getKubeConfig(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg, err := clientcmd.RESTConfigFromKubeConfig(kubeConfig)
+		if err != nil {
+			return nil, err
+		}
+		restConfig = runtimeClient.KubeConfig(cfg, r.KubeConfigOpts)
+	} else {
+		if r.restConfig == nil {
+			return nil, fmt.Errorf("no REST config available")
+		}
+		restConfig = rest.CopyConfig(r.restConfig)
+	}
+
+	if name := r.impersonatedServiceAccount(obj); name != "" {
+		restConfig.Impersonate = rest.ImpersonationConfig{
+			UserName: fmt.Sprintf("system:serviceaccount:%s:%s", obj.GetNamespace(), name),
+		}
+	}
+
+	return restConfig, nil
+}
+
+// impersonatedServiceAccount returns the name of the service account
+// impersonated for the given CueInstance, or an empty string if none is.
+func (r *CueInstanceReconciler) impersonatedServiceAccount(obj *cueinstancev1a1.CueInstance) string {
+	if sa := obj.Spec.ServiceAccountName; sa != "" {
+		return sa
+	}
+	return r.DefaultServiceAccount
+}
+
+// getKubeConfig returns the kubeconfig of the KubeConfig secret referenced
+// by the given CueInstance.
+func (r *CueInstanceReconciler) getKubeConfig(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance) ([]byte, error) {
+	secretName := types.NamespacedName{
+		Namespace: obj.GetNamespace(),
+		Name:      obj.Spec.KubeConfig.SecretRef.Name,
+	}
+
+	var secret corev1.Secret
+	if err := r.Get(ctx, secretName, &secret); err != nil {
+		return nil, fmt.Errorf("unable to read KubeConfig secret '%s' error: %w", secretName.String(), err)
+	}
+
+	var kubeConfig []byte
+	switch {
+	case obj.Spec.KubeConfig.SecretRef.Key != "":
+		key := obj.Spec.KubeConfig.SecretRef.Key
+		kubeConfig = secret.Data[key]
+		if kubeConfig == nil {
+			return nil, fmt.Errorf("KubeConfig secret '%s' does not contain a '%s' key with a kubeconfig", secretName, key)
+		}
+	case secret.Data["value"] != nil:
+		kubeConfig = secret.Data["value"]
+	case secret.Data["value.yaml"] != nil:
+		kubeConfig = secret.Data["value.yaml"]
+	default:
+		return nil, fmt.Errorf("KubeConfig secret '%s' does not contain a 'value' key with a kubeconfig", secretName)
+	}
+
+	return kubeConfig, nil
+}
@@ -62,6 +62,65 @@ func (r *CueInstanceReconciler) requestsForRevisionChangeOf(indexKey string) han
 	}
 }
 
+func (r *CueInstanceReconciler) requestsForResourceVersionChangeOf(indexKey string) handler.MapFunc {
+	return r.requestsForIndexedChangeOf(indexKey, "resource version change")
+}
+
+func (r *CueInstanceReconciler) requestsForDependencyReadyOf(indexKey string) handler.MapFunc {
+	return r.requestsForIndexedChangeOf(indexKey, "dependency change")
+}
+
+// requestsForIndexedChangeOf returns the requests for all the CueInstances
+// referencing the changed object through the given index, in dependency order.
+func (r *CueInstanceReconciler) requestsForIndexedChangeOf(indexKey, change string) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		log := ctrl.LoggerFrom(ctx)
+
+		var list cueinstancev1a1.CueInstanceList
+		if err := r.List(ctx, &list, client.MatchingFields{
+			indexKey: client.ObjectKeyFromObject(obj).String(),
+		}); err != nil {
+			log.Error(err, "failed to list objects for "+change)
+			return nil
+		}
+
+		var dd []dependency.Dependent
+		for _, d := range list.Items {
+			dd = append(dd, d.DeepCopy())
+		}
+		sorted, err := dependency.Sort(dd)
+		if err != nil {
+			log.Error(err, "failed to sort dependencies for "+change)
+			return nil
+		}
+		reqs := make([]reconcile.Request, len(sorted))
+		for i := range sorted {
+			reqs[i].NamespacedName.Name = sorted[i].Name
+			reqs[i].NamespacedName.Namespace = sorted[i].Namespace
+		}
+		return reqs
+	}
+}
+
+// indexByDependsOn returns the keys of the CueInstances in the dependsOn of
+// a CueInstance.
+func (r *CueInstanceReconciler) indexByDependsOn(o client.Object) []string {
+	c, ok := o.(*cueinstancev1a1.CueInstance)
+	if !ok {
+		panic(fmt.Sprintf("Expected a CueInstance, got %T", o))
+	}
+
+	var keys []string
+	for _, d := range c.GetDependsOn() {
+		namespace := c.GetNamespace()
+		if d.Namespace != "" {
+			namespace = d.Namespace
+		}
+		keys = append(keys, fmt.Sprintf("%s/%s", namespace, d.Name))
+	}
+	return keys
+}
+
 func (r *CueInstanceReconciler) indexBy(kind string) func(o client.Object) []string {
 	return func(o client.Object) []string {
 		c, ok := o.(*cueinstancev1a1.CueInstance)
@@ -69,14 +128,27 @@ func (r *CueInstanceReconciler) indexBy(kind string) func(o client.Object) []str
 			panic(fmt.Sprintf("Expected a CueInstance, got %T", o))
 		}
 
-		if c.Spec.SourceRef.Kind == kind {
+		var keys []string
+		if c.Spec.SourceRef != nil && c.Spec.SourceRef.Kind == kind {
 			namespace := c.GetNamespace()
 			if c.Spec.SourceRef.Namespace != "" {
 				namespace = c.Spec.SourceRef.Namespace
 			}
-			return []string{fmt.Sprintf("%s/%s", namespace, c.Spec.SourceRef.Name)}
+			keys = append(keys, fmt.Sprintf("%s/%s", namespace, c.Spec.SourceRef.Name))
+		}
+
+		for _, o := range c.Spec.OverlaysFrom {
+			if o.Kind == kind {
+				keys = append(keys, fmt.Sprintf("%s/%s", c.GetNamespace(), o.Name))
+			}
+		}
+
+		for _, v := range c.Spec.ValuesFrom {
+			if v.Kind == kind {
+				keys = append(keys, fmt.Sprintf("%s/%s", c.GetNamespace(), v.Name))
+			}
 		}
 
-		return nil
+		return keys
 	}
 }
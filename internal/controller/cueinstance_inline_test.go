@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_Inline(t *testing.T) {
+	g := NewWithT(t)
+	id := "inline-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cmName := "inline-" + randStringRunes(5)
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"out",
+			},
+			Tags: []cueinstancev1a1.TagVar{
+				{
+					Name:  "name",
+					Value: cmName,
+				},
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      string @tag(name)
+		namespace: %q
+	}
+	data: foo: "bar"
+}]
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var revision string
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		revision = obj.Status.LastAppliedRevision
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+	g.Expect(strings.HasPrefix(revision, InlineSourceKind+"@sha256:")).To(BeTrue())
+
+	cm := &corev1.ConfigMap{}
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      cmName,
+		Namespace: id,
+	}, cm)).To(Succeed())
+	g.Expect(cm.Data).To(HaveKeyWithValue("foo", "bar"))
+
+	// Changing the inline content results in a new revision.
+	cinst := &cueinstancev1a1.CueInstance{}
+	g.Expect(k8sClient.Get(context.TODO(), cueInstanceKey, cinst)).To(Succeed())
+	patch := client.MergeFrom(cinst.DeepCopy())
+	cinst.Spec.Inline[0].Content = strings.Replace(cinst.Spec.Inline[0].Content, `"bar"`, `"baz"`, 1)
+	g.Expect(k8sClient.Patch(context.TODO(), cinst, patch)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), cueInstanceKey, &obj)
+		return isReconcileSuccess(&obj) && obj.Status.LastAppliedRevision != revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      cmName,
+		Namespace: id,
+	}, cm)).To(Succeed())
+	g.Expect(cm.Data).To(HaveKeyWithValue("foo", "baz"))
+}
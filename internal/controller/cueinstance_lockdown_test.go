@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_DefaultServiceAccount(t *testing.T) {
+	g := NewWithT(t)
+	id := "lockdown-" + randStringRunes(5)
+	saName := "cue-reconciler"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	startTestReconciler(t, id, CueInstanceReconcilerOptions{}, func(r *CueInstanceReconciler) {
+		r.DefaultServiceAccount = saName
+	})
+
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      saName,
+			Namespace: id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), sa)).To(Succeed())
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+			Labels: map[string]string{
+				testReconcilerLabel: id,
+			},
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+config: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "config"
+		namespace: %q
+	}
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	// Without RBAC the default service account is not allowed to apply.
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.IsFalse(&obj, meta.ReadyCondition) &&
+			obj.Status.LastAttemptedRevision != ""
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(conditions.GetMessage(&obj, meta.ReadyCondition)).
+		To(ContainSubstring("system:serviceaccount:%s:%s", id, saName))
+
+	configKey := types.NamespacedName{Name: "config", Namespace: id}
+	err = k8sClient.Get(context.TODO(), configKey, &corev1.ConfigMap{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+	// Granting the service account access to the namespace unblocks it.
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      saName,
+			Namespace: id,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     "admin",
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      saName,
+				Namespace: id,
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), binding)).To(Succeed())
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(k8sClient.Get(context.TODO(), configKey, &corev1.ConfigMap{})).To(Succeed())
+}
+
+func TestCueInstanceReconciler_NoRemoteBases(t *testing.T) {
+	g := NewWithT(t)
+	id := "no-remote-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	startTestReconciler(t, id, CueInstanceReconcilerOptions{}, func(r *CueInstanceReconciler) {
+		r.NoRemoteBases = true
+	})
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+			Labels: map[string]string{
+				testReconcilerLabel: id,
+			},
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+import corev1 "k8s.io/api/core/v1"
+
+config: corev1.#ConfigMap & {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "config"
+		namespace: %q
+	}
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.GetReason(&obj, meta.ReadyCondition) == cueinstancev1a1.BuildFailedReason
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(conditions.GetMessage(&obj, meta.ReadyCondition)).
+		To(ContainSubstring("package 'k8s.io/api/core/v1' is not vendored"))
+}
@@ -69,7 +69,7 @@ func TestCueInstanceReconciler_MultiEnv(t *testing.T) {
 					Name: "kubeconfig",
 				},
 			},
-			SourceRef: cueinstancev1a1.CrossNamespaceSourceReference{
+			SourceRef: &cueinstancev1a1.CrossNamespaceSourceReference{
 				Name:      repositoryName.Name,
 				Namespace: repositoryName.Namespace,
 				Kind:      sourcev1.GitRepositoryKind,
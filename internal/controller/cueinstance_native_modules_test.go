@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_NativeModules(t *testing.T) {
+	g := NewWithT(t)
+	id := "native-" + randStringRunes(5)
+
+	// In-process OCI registry requiring basic auth.
+	username, password := "cue", randStringRunes(10)
+	handler := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	host := serverURL.Host
+
+	// Publish a module in the layout of the CUE module registries.
+	var zipData bytes.Buffer
+	zw := zip.NewWriter(&zipData)
+	for name, content := range map[string]string{
+		"cue.mod/module.cue": `module: "example.com/lib@v0"
+language: version: "v0.9.0"
+`,
+		"lib.cue": `package lib
+
+#ConfigMap: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      string
+		namespace: string
+	}
+}
+`,
+	} {
+		f, err := zw.Create(name)
+		g.Expect(err).NotTo(HaveOccurred())
+		_, err = f.Write([]byte(content))
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	g.Expect(zw.Close()).To(Succeed())
+
+	img, err := mutate.AppendLayers(
+		mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1),
+			"application/vnd.cue.module.v1+json"),
+		static.NewLayer(zipData.Bytes(), "application/zip"),
+	)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ref, err := name.ParseReference(host+"/modules/example.com/lib:v0.1.0", name.Insecure)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(remote.Write(ref, img, remote.WithAuth(&authn.Basic{
+		Username: username,
+		Password: password,
+	}))).To(Succeed())
+
+	err = createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "registry",
+			Namespace: id,
+		},
+		StringData: map[string]string{
+			"username": username,
+			"password": password,
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), secret)).To(Succeed())
+
+	cueInstanceKey := k8stypes.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Dependencies: &cueinstancev1a1.Dependencies{
+				Manager:  cueinstancev1a1.NativeDependencyManager,
+				Registry: host + "/modules+insecure",
+				SecretRef: &meta.LocalObjectReference{
+					Name: secret.Name,
+				},
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "cue.mod/module.cue",
+					Content: `module: "example.com/app@v0"
+language: version: "v0.9.0"
+deps: "example.com/lib@v0": v: "v0.1.0"
+`,
+				},
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+import "example.com/lib@v0:lib"
+
+config: lib.#ConfigMap & {
+	metadata: {
+		name:      "config"
+		namespace: %q
+	}
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(obj.Status.ResolvedDependencies).To(Equal([]cueinstancev1a1.ModuleVersion{
+		{Module: "example.com/lib@v0", Version: "v0.1.0"},
+	}))
+
+	g.Expect(k8sClient.Get(context.TODO(), k8stypes.NamespacedName{
+		Name:      "config",
+		Namespace: id,
+	}, &corev1.ConfigMap{})).To(Succeed())
+}
@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"cuelang.org/go/cue"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	cuemanageri "github.com/akirill0v/cue-flux-controller/internal/cue"
+)
+
+// openAPICache caches the OpenAPI schemas of the group versions served by
+// the target clusters. The API server publishes each group version with a
+// hash of its schemas, which changes with the CRDs defining it, so entries
+// are refreshed when the hash differs.
+type openAPICache struct {
+	mu      sync.Mutex
+	entries map[string]*openAPICacheEntry
+}
+
+type openAPICacheEntry struct {
+	hash    string
+	schemas *cuemanageri.OpenAPISchemas
+}
+
+func newOpenAPICache() *openAPICache {
+	return &openAPICache{entries: map[string]*openAPICacheEntry{}}
+}
+
+func (c *openAPICache) get(key, hash string) *cuemanageri.OpenAPISchemas {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && e.hash == hash {
+		return e.schemas
+	}
+	return nil
+}
+
+func (c *openAPICache) set(key, hash string, schemas *cuemanageri.OpenAPISchemas) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &openAPICacheEntry{hash: hash, schemas: schemas}
+}
+
+// openAPISchemas looks up the OpenAPI schemas of the target cluster of a
+// CueInstance during a build. The group versions are discovered on first
+// use, through the impersonated client. Errors are remembered for the rest
+// of the build, so that the cluster is not queried again for each object.
+type openAPISchemas struct {
+	r    *CueInstanceReconciler
+	ctx  context.Context
+	obj  *cueinstancev1a1.CueInstance
+	cctx *cue.Context
+
+	host       string
+	restClient rest.Interface
+	discovered bool
+	err        error
+	paths      map[string]string
+	failed     map[string]error
+	values     map[string]cue.Value
+}
+
+func (r *CueInstanceReconciler) newOpenAPISchemas(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	cctx *cue.Context) *openAPISchemas {
+	return &openAPISchemas{
+		r:      r,
+		ctx:    ctx,
+		obj:    obj,
+		cctx:   cctx,
+		failed: map[string]error{},
+		values: map[string]cue.Value{},
+	}
+}
+
+// schema returns the schema of the given kind, and false if the target
+// cluster does not serve it.
+func (s *openAPISchemas) schema(apiVersion, kind string) (cue.Value, bool, error) {
+	key := apiVersion + "/" + kind
+	if v, ok := s.values[key]; ok {
+		return v, true, nil
+	}
+
+	if !s.discovered {
+		s.discovered = true
+		s.err = s.discover()
+	}
+	if s.err != nil {
+		return cue.Value{}, false, s.err
+	}
+
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return cue.Value{}, false, err
+	}
+	path := "apis/" + gv.String()
+	if gv.Group == "" {
+		path = "api/" + gv.Version
+	}
+
+	relativeURL, ok := s.paths[path]
+	if !ok {
+		return cue.Value{}, false, nil
+	}
+	if err := s.failed[path]; err != nil {
+		return cue.Value{}, false, err
+	}
+
+	locator, err := url.Parse(relativeURL)
+	if err != nil {
+		return cue.Value{}, false, err
+	}
+	cacheKey := s.host + "/" + path
+	hash := locator.Query().Get("hash")
+
+	schemas := s.r.openAPICache.get(cacheKey, hash)
+	if schemas == nil {
+		schemas, err = s.fetch(relativeURL)
+		if err != nil {
+			s.failed[path] = fmt.Errorf("failed to fetch the OpenAPI schemas of '%s': %w", gv, err)
+			return cue.Value{}, false, s.failed[path]
+		}
+		s.r.openAPICache.set(cacheKey, hash, schemas)
+	}
+
+	v, ok, err := schemas.Schema(s.cctx, apiVersion, kind)
+	if err != nil || !ok {
+		return cue.Value{}, false, err
+	}
+	s.values[key] = v
+	return v, true, nil
+}
+
+// fetch returns the OpenAPI schemas published at the given URL, converted
+// to CUE.
+func (s *openAPISchemas) fetch(relativeURL string) (*cuemanageri.OpenAPISchemas, error) {
+	data, err := s.restClient.Get().
+		RequestURI(relativeURL).
+		SetHeader("Accept", "application/json").
+		Do(s.ctx).
+		Raw()
+	if err != nil {
+		return nil, err
+	}
+	return cuemanageri.CueOpenAPISchemas(data)
+}
+
+// discover fetches the group versions for which the target cluster
+// publishes OpenAPI v3 schemas.
+func (s *openAPISchemas) discover() error {
+	restConfig, err := s.r.impersonatedRESTConfig(s.ctx, s.obj)
+	if err != nil {
+		return err
+	}
+
+	client, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	s.restClient = client.RESTClient()
+	s.host = strings.TrimSuffix(restConfig.Host, "/")
+
+	data, err := s.restClient.Get().AbsPath("/openapi/v3").Do(s.ctx).Raw()
+	if err != nil {
+		return fmt.Errorf("failed to discover the OpenAPI schemas: %w", err)
+	}
+
+	var discovered struct {
+		Paths map[string]struct {
+			ServerRelativeURL string `json:"serverRelativeURL"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &discovered); err != nil {
+		return fmt.Errorf("failed to decode the OpenAPI discovery document: %w", err)
+	}
+
+	s.paths = make(map[string]string, len(discovered.Paths))
+	for path, p := range discovered.Paths {
+		s.paths[path] = p.ServerRelativeURL
+	}
+	return nil
+}
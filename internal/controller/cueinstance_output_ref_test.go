@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_OutputRef(t *testing.T) {
+	g := NewWithT(t)
+	id := "output-ref-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	infra := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "infra",
+			Namespace: id,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"out",
+			},
+			Outputs: map[string]string{
+				"endpoint": "db.endpoint",
+				"replicas": "db.replicas",
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+db: {
+	endpoint: "postgres:5432"
+	replicas: 3
+}
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ServiceAccount"
+	metadata: {
+		name:      "postgres"
+		namespace: %q
+	}
+}]
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	app := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: id,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"out",
+			},
+			DependsOn: []cueinstancev1a1.DependencyReference{
+				{
+					Name: infra.Name,
+				},
+			},
+			TagVars: []cueinstancev1a1.TagVar{
+				{
+					Name: "endpoint",
+					ValueFrom: &cueinstancev1a1.TagVarSource{
+						CueInstanceOutputRef: &cueinstancev1a1.CueInstanceOutputReference{
+							Name:   infra.Name,
+							Output: "endpoint",
+						},
+					},
+				},
+			},
+			ValuesFrom: []cueinstancev1a1.ValuesReference{
+				{
+					Kind: cueinstancev1a1.CueInstanceKind,
+					Name: infra.Name,
+				},
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+_endpoint: string @tag(endpoint,var=endpoint)
+
+values: replicas: int
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "app"
+		namespace: %q
+	}
+	data: {
+		endpoint: _endpoint
+		replicas: "\(values.replicas)"
+	}
+}]
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	// The dependent is created first and waits for the outputs.
+	g.Expect(k8sClient.Create(context.TODO(), app)).To(Succeed())
+	g.Expect(k8sClient.Create(context.TODO(), infra)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(app), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	cm := &corev1.ConfigMap{}
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "app",
+		Namespace: id,
+	}, cm)).To(Succeed())
+	g.Expect(cm.Data).To(HaveKeyWithValue("endpoint", "postgres:5432"))
+	g.Expect(cm.Data).To(HaveKeyWithValue("replicas", "3"))
+}
@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"cuelang.org/go/cue"
+	cueerrors "cuelang.org/go/cue/errors"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/fluxcd/pkg/runtime/acl"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// evaluateOutputs returns the JSON encoded values of the spec outputs,
+// which must be concrete.
+func evaluateOutputs(obj *cueinstancev1a1.CueInstance, value cue.Value) (map[string]apiextensionsv1.JSON, error) {
+	if len(obj.Spec.Outputs) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(obj.Spec.Outputs))
+	for name := range obj.Spec.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	outputs := make(map[string]apiextensionsv1.JSON, len(names))
+	for _, name := range names {
+		p := obj.Spec.Outputs[name]
+		path := cue.ParsePath(p)
+		if path.Err() != nil {
+			return nil, fmt.Errorf("output '%s': invalid path '%s': %w", name, p, path.Err())
+		}
+
+		v := value.LookupPath(path)
+		if !v.Exists() {
+			return nil, fmt.Errorf("output '%s': path '%s' not found", name, p)
+		}
+		if err := v.Validate(cue.Concrete(true)); err != nil {
+			return nil, fmt.Errorf("output '%s': %s", name, cueerrors.Details(err, nil))
+		}
+
+		data, err := v.MarshalJSON()
+		if err != nil {
+			return nil, fmt.Errorf("output '%s': %s", name, cueerrors.Details(err, nil))
+		}
+		outputs[name] = apiextensionsv1.JSON{Raw: data}
+	}
+	return outputs, nil
+}
+
+// outputsOwnerLabel is set to the name of the CueInstance on its outputs
+// ConfigMap, so that the previous ConfigMap is found when it is renamed.
+var outputsOwnerLabel = fmt.Sprintf("%s/outputs-owner", cueinstancev1a1.GroupVersion.Group)
+
+// outputsConfigMapObject returns the outputs ConfigMap of the given
+// CueInstance as an unstructured object, or nil if the outputs are not
+// exported into a ConfigMap.
+func outputsConfigMapObject(obj *cueinstancev1a1.CueInstance) *unstructured.Unstructured {
+	if obj.Spec.OutputsConfigMap == nil {
+		return nil
+	}
+
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMap"))
+	u.SetName(obj.Spec.OutputsConfigMap.Name)
+	u.SetNamespace(obj.GetNamespace())
+	return u
+}
+
+// exportOutputs sets the outputs in the status and, when configured, writes
+// them into the outputs ConfigMap owned by the CueInstance. The ConfigMap is
+// written with the impersonated client, and an existing ConfigMap is only
+// updated if it is controlled by the CueInstance. The ConfigMaps previously
+// exported under another name are deleted.
+func (r *CueInstanceReconciler) exportOutputs(ctx context.Context,
+	kubeClient client.Client,
+	obj *cueinstancev1a1.CueInstance,
+	outputs map[string]apiextensionsv1.JSON) error {
+	exported := obj.Status.Outputs != nil
+	obj.Status.Outputs = outputs
+
+	if obj.Spec.OutputsConfigMap == nil {
+		// Only look for a previous ConfigMap if outputs were exported, so
+		// that the ConfigMaps need not be readable otherwise.
+		if !exported {
+			return nil
+		}
+		return r.pruneOutputs(ctx, kubeClient, obj, "")
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      obj.Spec.OutputsConfigMap.Name,
+			Namespace: obj.GetNamespace(),
+		},
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, kubeClient, cm, func() error {
+		if cm.ResourceVersion != "" && !metav1.IsControlledBy(cm, obj) {
+			return fmt.Errorf("ConfigMap '%s' exists and is not controlled by the CueInstance", cm.Name)
+		}
+		if cm.Labels == nil {
+			cm.Labels = map[string]string{}
+		}
+		cm.Labels[outputsOwnerLabel] = obj.GetName()
+		cm.Data = make(map[string]string, len(outputs))
+		for name, v := range outputs {
+			cm.Data[name] = outputString(v)
+		}
+		return controllerutil.SetControllerReference(obj, cm, r.Client.Scheme())
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export outputs to ConfigMap '%s': %w", cm.Name, err)
+	}
+
+	return r.pruneOutputs(ctx, kubeClient, obj, cm.Name)
+}
+
+// pruneOutputs deletes the outputs ConfigMaps controlled by the given
+// CueInstance, other than the named one.
+func (r *CueInstanceReconciler) pruneOutputs(ctx context.Context,
+	kubeClient client.Client,
+	obj *cueinstancev1a1.CueInstance,
+	keep string) error {
+	var list corev1.ConfigMapList
+	if err := kubeClient.List(ctx, &list,
+		client.InNamespace(obj.GetNamespace()),
+		client.MatchingLabels{outputsOwnerLabel: obj.GetName()}); err != nil {
+		return fmt.Errorf("failed to list the outputs ConfigMaps: %w", err)
+	}
+
+	for i := range list.Items {
+		cm := &list.Items[i]
+		if cm.Name == keep || !metav1.IsControlledBy(cm, obj) {
+			continue
+		}
+		if err := kubeClient.Delete(ctx, cm); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to delete the outputs ConfigMap '%s': %w", cm.Name, err)
+		}
+		ctrl.LoggerFrom(ctx).Info(fmt.Sprintf("deleted the outputs ConfigMap '%s'", cm.Name))
+	}
+	return nil
+}
+
+// outputString returns the value of a string output as is and the JSON
+// encoding of any other output.
+func outputString(v apiextensionsv1.JSON) string {
+	var s string
+	if err := json.Unmarshal(v.Raw, &s); err == nil {
+		return s
+	}
+	return string(v.Raw)
+}
+
+// getDependencyOutputs returns the outputs of the named CueInstance, which
+// must be listed in the dependsOn of the given CueInstance so that its
+// outputs are only read once it is ready at the current revision.
+func (r *CueInstanceReconciler) getDependencyOutputs(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	name types.NamespacedName) (map[string]apiextensionsv1.JSON, error) {
+	if name.Namespace == "" {
+		name.Namespace = obj.GetNamespace()
+	}
+
+	if r.NoCrossNamespaceRefs && name.Namespace != obj.GetNamespace() {
+		return nil, acl.AccessDeniedError(
+			fmt.Sprintf("can't access '%s/%s', cross-namespace references have been blocked",
+				cueinstancev1a1.CueInstanceKind, name))
+	}
+
+	dependency := false
+	for _, d := range obj.Spec.DependsOn {
+		if !d.IsCueInstance() {
+			continue
+		}
+		namespace := d.Namespace
+		if namespace == "" {
+			namespace = obj.GetNamespace()
+		}
+		if d.Name == name.Name && namespace == name.Namespace {
+			dependency = true
+			break
+		}
+	}
+	if !dependency {
+		return nil, fmt.Errorf("CueInstance '%s' must be listed in dependsOn to use its outputs", name)
+	}
+
+	var c cueinstancev1a1.CueInstance
+	if err := r.Get(ctx, name, &c); err != nil {
+		return nil, fmt.Errorf("unable to get CueInstance '%s': %w", name, err)
+	}
+	return c.Status.Outputs, nil
+}
+
+// getOutputValue returns the value of the referenced output, the value of a
+// string output as is and the JSON encoding of any other output.
+func (r *CueInstanceReconciler) getOutputValue(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	ref *cueinstancev1a1.CueInstanceOutputReference) (string, error) {
+	if ref == nil {
+		return "", fmt.Errorf("valueFrom has no cueInstanceOutputRef")
+	}
+
+	outputs, err := r.getDependencyOutputs(ctx, obj, types.NamespacedName{
+		Namespace: ref.Namespace,
+		Name:      ref.Name,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	v, ok := outputs[ref.Output]
+	if !ok {
+		return "", fmt.Errorf("output '%s' not found", ref.String())
+	}
+	return outputString(v), nil
+}
@@ -0,0 +1,423 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_Outputs(t *testing.T) {
+	g := NewWithT(t)
+	id := "outputs-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"out",
+			},
+			Outputs: map[string]string{
+				"endpoint": "db.endpoint",
+				"port":     "db.port",
+				"labels":   "db.labels",
+			},
+			OutputsConfigMap: &meta.LocalObjectReference{
+				Name: "outputs",
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+db: {
+	host:     "postgres"
+	port:     5432
+	endpoint: "\(host):\(port)"
+	labels: tier: "data"
+}
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ServiceAccount"
+	metadata: {
+		name:      db.host
+		namespace: %q
+	}
+}]
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(obj.Status.Outputs).To(HaveLen(3))
+	g.Expect(string(obj.Status.Outputs["endpoint"].Raw)).To(Equal(`"postgres:5432"`))
+	g.Expect(string(obj.Status.Outputs["port"].Raw)).To(Equal(`5432`))
+
+	cm := &corev1.ConfigMap{}
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "outputs",
+		Namespace: id,
+	}, cm)).To(Succeed())
+	g.Expect(cm.Data).To(HaveKeyWithValue("endpoint", "postgres:5432"))
+	g.Expect(cm.Data).To(HaveKeyWithValue("port", "5432"))
+	g.Expect(cm.Data).To(HaveKeyWithValue("labels", `{"tier":"data"}`))
+	g.Expect(metav1.IsControlledBy(cm, &obj)).To(BeTrue())
+
+	// Renaming the outputs ConfigMap deletes the previous one.
+	patch := client.MergeFrom(obj.DeepCopy())
+	obj.Spec.OutputsConfigMap.Name = "renamed-outputs"
+	g.Expect(k8sClient.Patch(context.TODO(), &obj, patch)).To(Succeed())
+
+	g.Eventually(func() bool {
+		err := k8sClient.Get(context.TODO(), types.NamespacedName{
+			Name:      "outputs",
+			Namespace: id,
+		}, &corev1.ConfigMap{})
+		return apierrors.IsNotFound(err)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "renamed-outputs",
+		Namespace: id,
+	}, cm)).To(Succeed())
+	g.Expect(cm.Data).To(HaveKeyWithValue("endpoint", "postgres:5432"))
+}
+
+func TestCueInstanceReconciler_OutputsPolicy(t *testing.T) {
+	g := NewWithT(t)
+	id := "outputs-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "inst-" + randStringRunes(5),
+			Namespace: id,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval:     metav1.Duration{Duration: reconciliationInterval},
+			AllowedKinds: []string{"ServiceAccount"},
+			Exprs: []string{
+				"out",
+			},
+			Outputs: map[string]string{
+				"endpoint": "endpoint",
+			},
+			OutputsConfigMap: &meta.LocalObjectReference{
+				Name: "outputs",
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+endpoint: "postgres:5432"
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ServiceAccount"
+	metadata: {
+		name:      "postgres"
+		namespace: %q
+	}
+}]
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	// The outputs ConfigMap is subject to the allowed kinds.
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.IsTrue(&obj, cueinstancev1a1.PolicyViolationCondition)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(conditions.GetMessage(&obj, cueinstancev1a1.PolicyViolationCondition)).
+		To(ContainSubstring("ConfigMap/%s/outputs", id))
+
+	err = k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "outputs",
+		Namespace: id,
+	}, &corev1.ConfigMap{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestCueInstanceReconciler_OutputsConfigMapNotControlled(t *testing.T) {
+	g := NewWithT(t)
+	id := "outputs-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-config",
+			Namespace: id,
+		},
+		Data: map[string]string{
+			"endpoint": "unchanged",
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), existing)).To(Succeed())
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "inst-" + randStringRunes(5),
+			Namespace: id,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"out",
+			},
+			Outputs: map[string]string{
+				"endpoint": "endpoint",
+			},
+			OutputsConfigMap: &meta.LocalObjectReference{
+				Name: existing.Name,
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+endpoint: "postgres:5432"
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ServiceAccount"
+	metadata: {
+		name:      "postgres"
+		namespace: %q
+	}
+}]
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	// The ConfigMap is not taken over by the CueInstance.
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.IsFalse(&obj, meta.ReadyCondition) &&
+			obj.Status.LastAttemptedRevision != ""
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(conditions.GetMessage(&obj, meta.ReadyCondition)).
+		To(ContainSubstring("is not controlled by the CueInstance"))
+
+	cm := &corev1.ConfigMap{}
+	g.Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(existing), cm)).To(Succeed())
+	g.Expect(cm.Data).To(Equal(existing.Data))
+	g.Expect(metav1.GetControllerOf(cm)).To(BeNil())
+}
+
+func TestCueInstanceReconciler_OutputsImpersonation(t *testing.T) {
+	g := NewWithT(t)
+	id := "outputs-" + randStringRunes(5)
+	saName := "cue-reconciler"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      saName,
+			Namespace: id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), sa)).To(Succeed())
+
+	// The service account may apply the objects but not write ConfigMaps.
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      saName,
+			Namespace: id,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{""},
+				Resources: []string{"serviceaccounts"},
+				Verbs:     []string{"*"},
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), role)).To(Succeed())
+
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      saName,
+			Namespace: id,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     role.Name,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      saName,
+				Namespace: id,
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), binding)).To(Succeed())
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "inst-" + randStringRunes(5),
+			Namespace: id,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval:           metav1.Duration{Duration: reconciliationInterval},
+			ServiceAccountName: saName,
+			Exprs: []string{
+				"out",
+			},
+			Outputs: map[string]string{
+				"endpoint": "endpoint",
+			},
+			OutputsConfigMap: &meta.LocalObjectReference{
+				Name: "outputs",
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+endpoint: "postgres:5432"
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ServiceAccount"
+	metadata: {
+		name:      "postgres"
+		namespace: %q
+	}
+}]
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.IsFalse(&obj, meta.ReadyCondition) &&
+			obj.Status.LastAttemptedRevision != ""
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(conditions.GetMessage(&obj, meta.ReadyCondition)).
+		To(ContainSubstring("system:serviceaccount:%s:%s", id, saName))
+
+	// The objects are applied, the outputs ConfigMap is not written.
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "postgres",
+		Namespace: id,
+	}, &corev1.ServiceAccount{})).To(Succeed())
+
+	err = k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "outputs",
+		Namespace: id,
+	}, &corev1.ConfigMap{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+	// Granting the service account access to ConfigMaps unblocks it.
+	role.Rules = append(role.Rules, rbacv1.PolicyRule{
+		APIGroups: []string{""},
+		Resources: []string{"configmaps"},
+		Verbs:     []string{"*"},
+	})
+	g.Expect(k8sClient.Update(context.TODO(), role)).To(Succeed())
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	cm := &corev1.ConfigMap{}
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "outputs",
+		Namespace: id,
+	}, cm)).To(Succeed())
+	g.Expect(cm.Data).To(HaveKeyWithValue("endpoint", "postgres:5432"))
+	g.Expect(metav1.IsControlledBy(cm, &obj)).To(BeTrue())
+}
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/fluxcd/pkg/ssa"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// checkPolicy returns the objects which the given CueInstance may not
+// manage, according to the controller policy and its allowed kinds and
+// namespaces, with the reason why. The outputs ConfigMap is checked along
+// with the objects.
+func (r *CueInstanceReconciler) checkPolicy(obj *cueinstancev1a1.CueInstance,
+	kubeClient client.Client,
+	objects []*unstructured.Unstructured) ([]string, error) {
+	if cm := outputsConfigMapObject(obj); cm != nil {
+		objects = append(objects[:len(objects):len(objects)], cm)
+	}
+
+	allowedKinds := make(map[schema.GroupKind]bool, len(obj.Spec.AllowedKinds))
+	for _, k := range obj.Spec.AllowedKinds {
+		allowedKinds[schema.ParseGroupKind(k)] = true
+	}
+
+	allowedNamespaces := make(map[string]bool, len(obj.Spec.AllowedNamespaces))
+	for _, ns := range obj.Spec.AllowedNamespaces {
+		allowedNamespaces[ns] = true
+	}
+
+	// The scope of the custom resources defined in the same set cannot be
+	// looked up in the cluster.
+	definedScopes := map[schema.GroupKind]string{}
+	for _, u := range objects {
+		if u.GroupVersionKind().GroupKind() == crdGroupKind {
+			group, _, _ := unstructured.NestedString(u.Object, "spec", "group")
+			kind, _, _ := unstructured.NestedString(u.Object, "spec", "names", "kind")
+			scope, _, _ := unstructured.NestedString(u.Object, "spec", "scope")
+			definedScopes[schema.GroupKind{Group: group, Kind: kind}] = scope
+		}
+	}
+
+	var violations []string
+	for _, u := range objects {
+		gk := u.GroupVersionKind().GroupKind()
+		if len(allowedKinds) > 0 && !allowedKinds[gk] {
+			violations = append(violations, fmt.Sprintf("%s: kind '%s' is not allowed",
+				ssa.FmtUnstructured(u), gk.String()))
+			continue
+		}
+
+		namespaced, err := kubeClient.IsObjectNamespaced(u)
+		if scope, ok := definedScopes[gk]; ok {
+			namespaced, err = scope == "Namespaced", nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the scope of %s: %w", ssa.FmtUnstructured(u), err)
+		}
+
+		switch {
+		case namespaced:
+			if r.NoCrossNamespaceObjects && u.GetNamespace() != obj.GetNamespace() {
+				violations = append(violations, fmt.Sprintf("%s: objects outside of namespace '%s' are not allowed",
+					ssa.FmtUnstructured(u), obj.GetNamespace()))
+			} else if len(allowedNamespaces) > 0 && !allowedNamespaces[u.GetNamespace()] {
+				violations = append(violations, fmt.Sprintf("%s: namespace '%s' is not allowed",
+					ssa.FmtUnstructured(u), u.GetNamespace()))
+			}
+		case r.NoClusterScopedObjects:
+			violations = append(violations, fmt.Sprintf("%s: cluster-scoped objects are not allowed",
+				ssa.FmtUnstructured(u)))
+		case len(allowedNamespaces) > 0:
+			if gk == namespaceGroupKind && allowedNamespaces[u.GetName()] {
+				continue
+			}
+			violations = append(violations, fmt.Sprintf("%s: cluster-scoped objects are not allowed with allowed namespaces",
+				ssa.FmtUnstructured(u)))
+		}
+	}
+	return violations, nil
+}
+
+var (
+	crdGroupKind       = schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}
+	namespaceGroupKind = schema.GroupKind{Kind: "Namespace"}
+)
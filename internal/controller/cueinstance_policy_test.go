@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_Policy(t *testing.T) {
+	g := NewWithT(t)
+	id := "policy-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval:          metav1.Duration{Duration: reconciliationInterval},
+			AllowedKinds:      []string{"ConfigMap"},
+			AllowedNamespaces: []string{id},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+allowed: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "allowed"
+		namespace: %[1]q
+	}
+}
+
+foreign: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "%[1]s-foreign"
+		namespace: "default"
+	}
+}
+
+account: {
+	apiVersion: "v1"
+	kind:       "ServiceAccount"
+	metadata: {
+		name:      "account"
+		namespace: %[1]q
+	}
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.IsTrue(&obj, cueinstancev1a1.PolicyViolationCondition)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(conditions.IsFalse(&obj, meta.ReadyCondition)).To(BeTrue())
+	g.Expect(conditions.GetReason(&obj, meta.ReadyCondition)).To(Equal(cueinstancev1a1.PolicyViolationReason))
+
+	msg := conditions.GetMessage(&obj, cueinstancev1a1.PolicyViolationCondition)
+	g.Expect(msg).To(ContainSubstring("ConfigMap/default/%s-foreign", id))
+	g.Expect(msg).To(ContainSubstring("ServiceAccount/%s/account", id))
+	g.Expect(msg).NotTo(ContainSubstring("ConfigMap/%s/allowed", id))
+
+	// Nothing is applied when an object violates the policy.
+	err = k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "allowed",
+		Namespace: id,
+	}, &corev1.ConfigMap{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
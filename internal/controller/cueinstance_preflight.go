@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fluxcd/pkg/ssa"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// preflight server-side dry-runs all the objects and returns an error
+// listing every rejected object. Objects of kinds defined by a CRD of the
+// same set, and objects in a namespace of the same set which does not exist
+// yet, cannot be dry-run and are skipped.
+func (r *CueInstanceReconciler) preflight(ctx context.Context,
+	manager *ssa.ResourceManager,
+	objects []*unstructured.Unstructured) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	if err := ssa.SetNativeKindsDefaults(objects); err != nil {
+		return err
+	}
+
+	definedKinds := map[schema.GroupKind]bool{}
+	namespaces := map[string]bool{}
+	for _, u := range objects {
+		switch u.GroupVersionKind().GroupKind() {
+		case crdGroupKind:
+			group, _, _ := unstructured.NestedString(u.Object, "spec", "group")
+			kind, _, _ := unstructured.NestedString(u.Object, "spec", "names", "kind")
+			definedKinds[schema.GroupKind{Group: group, Kind: kind}] = true
+		case namespaceGroupKind:
+			namespaces[u.GetName()] = true
+		}
+	}
+
+	opts := ssa.DiffOptions{
+		Exclusions: map[string]string{
+			fmt.Sprintf("%s/reconcile", cueinstancev1a1.GroupVersion.Group): cueinstancev1a1.DisabledValue,
+		},
+	}
+
+	var rejections []string
+	for _, u := range objects {
+		if definedKinds[u.GroupVersionKind().GroupKind()] {
+			log.V(1).Info("skipping dry-run of object defined in the same set", "object", ssa.FmtUnstructured(u))
+			continue
+		}
+
+		if _, _, _, err := manager.Diff(ctx, u, opts); err != nil {
+			if namespaces[u.GetNamespace()] && apierrors.IsNotFound(err) {
+				log.V(1).Info("skipping dry-run of object in a namespace of the same set", "object", ssa.FmtUnstructured(u))
+				continue
+			}
+			rejections = append(rejections, err.Error())
+		}
+	}
+
+	if len(rejections) > 0 {
+		return fmt.Errorf("dry-run failed for %d objects:\n%s", len(rejections), strings.Join(rejections, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_Preflight(t *testing.T) {
+	g := NewWithT(t)
+	id := "preflight-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval:  metav1.Duration{Duration: reconciliationInterval},
+			Preflight: true,
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+namespace: {
+	apiVersion: "v1"
+	kind:       "Namespace"
+	metadata: name: "%[1]s-app"
+}
+
+config: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "config"
+		namespace: "%[1]s-app"
+	}
+}
+
+service: {
+	apiVersion: "v1"
+	kind:       "Service"
+	metadata: {
+		name:      "service"
+		namespace: %[1]q
+	}
+	spec: ports: [{port: 99999}]
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.GetReason(&obj, meta.ReadyCondition) == cueinstancev1a1.ValidationFailedReason
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(conditions.IsFalse(&obj, meta.ReadyCondition)).To(BeTrue())
+	g.Expect(conditions.GetMessage(&obj, meta.ReadyCondition)).To(ContainSubstring("Service/%s/service", id))
+
+	// Nothing is applied when an object is rejected, including the objects
+	// of the earlier stages.
+	err = k8sClient.Get(context.TODO(), types.NamespacedName{Name: id + "-app"}, &corev1.Namespace{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
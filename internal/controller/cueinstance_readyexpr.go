@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/cue/format"
+	"cuelang.org/go/cue/parser"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// evaluateReadyExpr evaluates the readiness expression of a dependency with
+// its status in scope as 'status' and its outputs as 'outputs'. It returns
+// an error with the expression, its result and the values it references
+// unless the expression evaluates to true.
+func evaluateReadyExpr(dep *unstructured.Unstructured, expr string) error {
+	cctx := cuecontext.New()
+
+	status, _, _ := unstructured.NestedMap(dep.Object, "status")
+	outputs, _, _ := unstructured.NestedMap(dep.Object, "status", "outputs")
+	if status == nil {
+		status = map[string]interface{}{}
+	}
+	if outputs == nil {
+		outputs = map[string]interface{}{}
+	}
+
+	scope := cctx.Encode(map[string]interface{}{
+		"status":  status,
+		"outputs": outputs,
+	})
+	if scope.Err() != nil {
+		return scope.Err()
+	}
+
+	v := cctx.CompileString(expr, cue.Scope(scope))
+	if v.Err() != nil {
+		return fmt.Errorf("readiness expression '%s' failed: %s%s",
+			expr, v.Err(), referencedValues(scope, expr))
+	}
+
+	ready, err := v.Bool()
+	if err != nil {
+		return fmt.Errorf("readiness expression '%s' is not a bool: %s%s",
+			expr, err, referencedValues(scope, expr))
+	}
+	if !ready {
+		return fmt.Errorf("readiness expression '%s' evaluated to false%s",
+			expr, referencedValues(scope, expr))
+	}
+	return nil
+}
+
+// referencedValues returns the values of the selectors in expr, e.g.
+// ' (outputs.schemaVersion: 3)', or an empty string when there are none.
+func referencedValues(scope cue.Value, expr string) string {
+	e, err := parser.ParseExpr("", expr)
+	if err != nil {
+		return ""
+	}
+
+	var values []string
+	ast.Walk(e, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.SelectorExpr, *ast.IndexExpr:
+		default:
+			return true
+		}
+
+		src, err := format.Node(n)
+		if err != nil {
+			return true
+		}
+		path := cue.ParsePath(string(src))
+		if path.Err() != nil {
+			return true
+		}
+		v := scope.LookupPath(path)
+		if !v.Exists() {
+			values = append(values, fmt.Sprintf("%s: <not found>", src))
+			return false
+		}
+		values = append(values, fmt.Sprintf("%s: %v", src, v))
+		return false
+	}, nil)
+
+	if len(values) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", strings.Join(values, ", "))
+}
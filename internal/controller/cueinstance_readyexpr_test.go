@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_DependencyReadyExpr(t *testing.T) {
+	g := NewWithT(t)
+	id := "ready-expr-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	content := func(name string, schemaVersion int) string {
+		return fmt.Sprintf(`package main
+
+schemaVersion: %d
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      %q
+		namespace: %q
+	}
+}]
+`, schemaVersion, name, id)
+	}
+
+	db := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db",
+			Namespace: id,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"out",
+			},
+			Outputs: map[string]string{
+				"schemaVersion": "schemaVersion",
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name:    "main.cue",
+					Content: content("db", 3),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	app := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: id,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"out",
+			},
+			DependsOn: []cueinstancev1a1.DependencyReference{
+				{
+					Name:      db.Name,
+					ReadyExpr: "outputs.schemaVersion >= 5",
+				},
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name:    "main.cue",
+					Content: content("app", 1),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), db)).To(Succeed())
+	g.Expect(k8sClient.Create(context.TODO(), app)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(app), &obj)
+		return conditions.GetReason(&obj, meta.ReadyCondition) == cueinstancev1a1.DependencyNotReadyReason &&
+			strings.Contains(conditions.GetMessage(&obj, meta.ReadyCondition), "outputs.schemaVersion: 3")
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(db), db)).To(Succeed())
+	patch := client.MergeFrom(db.DeepCopy())
+	db.Spec.Inline[0].Content = content("db", 5)
+	g.Expect(k8sClient.Patch(context.TODO(), db, patch)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(app), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+}
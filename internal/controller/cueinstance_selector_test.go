@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_GlobExpressions(t *testing.T) {
+	g := NewWithT(t)
+	id := "glob-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"apps.*.objects",
+			},
+			ExcludeExprs: []string{
+				"apps.legacy",
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+apps: [Name=string]: objects: [{
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      Name
+		namespace: %q
+	}
+}]
+
+apps: frontend: _
+apps: backend:  _
+apps: legacy:   _
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	for _, name := range []string{"frontend", "backend"} {
+		g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+			Name:      name,
+			Namespace: id,
+		}, &corev1.ConfigMap{})).To(Succeed())
+	}
+
+	err = k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "legacy",
+		Namespace: id,
+	}, &corev1.ConfigMap{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestCueInstanceReconciler_NestedExcludeExpressions(t *testing.T) {
+	g := NewWithT(t)
+	id := "exclude-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"apps",
+				"lists",
+			},
+			// Both excludes are nested beneath the selected values.
+			ExcludeExprs: []string{
+				"apps.legacy",
+				"lists.1",
+			},
+			Extract: &cueinstancev1a1.Extraction{
+				Mode: cueinstancev1a1.RecursiveExtractionMode,
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+#ConfigMap: {
+	_name: string
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      _name
+		namespace: %q
+	}
+}
+
+apps: [Name=string]: objects: [#ConfigMap & {_name: Name}]
+
+apps: frontend: _
+apps: backend:  _
+apps: legacy:   _
+
+lists: [
+	#ConfigMap & {_name: "first"},
+	#ConfigMap & {_name: "second"},
+]
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	for _, name := range []string{"frontend", "backend", "first"} {
+		g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+			Name:      name,
+			Namespace: id,
+		}, &corev1.ConfigMap{})).To(Succeed())
+	}
+
+	for _, name := range []string{"legacy", "second"} {
+		err = k8sClient.Get(context.TODO(), types.NamespacedName{
+			Name:      name,
+			Namespace: id,
+		}, &corev1.ConfigMap{})
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue(), name)
+	}
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/load"
+	"k8s.io/client-go/discovery"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	cuemanageri "github.com/akirill0v/cue-flux-controller/internal/cue"
+)
+
+// builtinTagVars returns the tag variables available to every CueInstance,
+// on top of load.DefaultTagVars. The values are computed lazily, so the
+// Kubernetes version is only discovered if the CUE instance uses it.
+func (r *CueInstanceReconciler) builtinTagVars(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	src sourcev1.Source) map[string]load.TagVar {
+	sourceName := ""
+	if obj.Spec.SourceRef != nil {
+		sourceName = obj.Spec.SourceRef.Name
+	}
+
+	tagVars := load.DefaultTagVars()
+	for name, value := range map[string]string{
+		"flux_revision":         src.GetArtifact().Revision,
+		"flux_digest":           src.GetArtifact().Digest,
+		"flux_source_name":      sourceName,
+		"cueinstance_name":      obj.GetName(),
+		"cueinstance_namespace": obj.GetNamespace(),
+		"cluster_name":          r.ClusterName,
+	} {
+		value := value
+		tagVars[name] = load.TagVar{
+			Func: func() (ast.Expr, error) {
+				return ast.NewString(value), nil
+			},
+		}
+	}
+
+	tagVars["kubernetes_version"] = load.TagVar{
+		Func: func() (ast.Expr, error) {
+			version, err := r.serverVersion(ctx, obj)
+			if err != nil {
+				return nil, err
+			}
+			return ast.NewString(version), nil
+		},
+	}
+
+	return tagVars
+}
+
+// getTagVars returns the tag variables of the given CueInstance: the
+// builtins, overridden by the TagVars of the spec with their valueFrom
+// resolved.
+func (r *CueInstanceReconciler) getTagVars(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	src sourcev1.Source) (map[string]load.TagVar, error) {
+	tagVars := r.builtinTagVars(ctx, obj, src)
+	for _, t := range obj.Spec.TagVars {
+		t := t
+		if t.ValueFrom != nil {
+			value, err := r.getOutputValue(ctx, obj, t.ValueFrom.CueInstanceOutputRef)
+			if err != nil {
+				return nil, fmt.Errorf("tag '%s': %w", t.Name, err)
+			}
+			t.Value = value
+		}
+		if err := cuemanageri.ValidateTagValue(t); err != nil {
+			return nil, err
+		}
+		tagVars[t.Name] = load.TagVar{
+			Func: func() (ast.Expr, error) {
+				return cuemanageri.TagVarExpr(t)
+			},
+		}
+	}
+	return tagVars, nil
+}
+
+// serverVersion returns the version of the Kubernetes API server targeted by
+// the given CueInstance, as seen by the impersonated account.
+func (r *CueInstanceReconciler) serverVersion(ctx context.Context, obj *cueinstancev1a1.CueInstance) (string, error) {
+	restConfig, err := r.impersonatedRESTConfig(ctx, obj)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := client.ServerVersion()
+	if err != nil {
+		return "", fmt.Errorf("failed to discover the Kubernetes version: %w", err)
+	}
+	return info.GitVersion, nil
+}
@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_TypedTagVar(t *testing.T) {
+	g := NewWithT(t)
+	id := "builder-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	artifactFile := "instance-" + randStringRunes(5)
+	artifactChecksum, err := createArtifact(testServer, "testdata/typed-tagvars", artifactFile)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      randStringRunes(5),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifactFile, "main/"+artifactChecksum)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Root:     "./testdata/typed-tagvars",
+			Exprs: []string{
+				"out",
+			},
+			Tags: []cueinstancev1a1.TagVar{
+				{
+					Name:  "namespace",
+					Value: id,
+				},
+				{
+					Name:  "replicas",
+					Value: "2",
+					Type:  cueinstancev1a1.IntTagVarType,
+				},
+			},
+			TagVars: []cueinstancev1a1.TagVar{
+				{
+					Name:  "enabled",
+					Value: "false",
+					Type:  cueinstancev1a1.BoolTagVarType,
+				},
+				{
+					Name:  "weight",
+					Value: "1.5",
+					Type:  cueinstancev1a1.NumberTagVarType,
+				},
+				{
+					Name:  "ports",
+					Value: "[80, 443]",
+					Type:  cueinstancev1a1.JSONTagVarType,
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: &cueinstancev1a1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return obj.Status.LastAppliedRevision == "main/"+artifactChecksum
+	}, timeout, time.Second).Should(BeTrue())
+
+	cm := &corev1.ConfigMap{}
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "typed",
+		Namespace: id,
+	}, cm)).To(Succeed())
+	g.Expect(cm.Data).To(Equal(map[string]string{
+		"replicas": "3",
+		"enabled":  "true",
+		"weight":   "3.0",
+		"ports":    "80,443",
+	}))
+
+	// Invalid typed values are rejected at admission.
+	invalid := cueInstance.DeepCopy()
+	invalid.ObjectMeta = metav1.ObjectMeta{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+	invalid.Spec.TagVars[0].Value = "yes"
+	g.Expect(k8sClient.Create(context.TODO(), invalid)).ToNot(Succeed())
+}
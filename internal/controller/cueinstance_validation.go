@@ -0,0 +1,480 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cuelang.org/go/cue"
+	cueerrors "cuelang.org/go/cue/errors"
+	"cuelang.org/go/encoding/yaml"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	eventv1 "github.com/fluxcd/pkg/apis/event/v1beta1"
+	"github.com/fluxcd/pkg/runtime/conditions"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// validationSchemas holds the schemas fetched for the validations of a
+// CueInstance.
+type validationSchemas struct {
+	// refs holds the CUE sources of the schemaFrom references, keyed by
+	// reference.
+	refs map[string][]byte
+
+	// cueSchemas holds the CueSchemas selecting the CueInstance.
+	cueSchemas []fetchedCueSchema
+}
+
+// getSchemas returns the CUE sources of the schemas referenced by the
+// validations of the given CueInstance, and the CueSchemas selecting it
+// with their files written into dir.
+func (r *CueInstanceReconciler) getSchemas(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	dir string) (*validationSchemas, error) {
+	schemas := map[string][]byte{}
+	for _, v := range obj.GetValidations() {
+		ref := v.SchemaFrom
+		if ref == nil {
+			continue
+		}
+		if _, ok := schemas[ref.String()]; ok {
+			continue
+		}
+
+		namespacedName := types.NamespacedName{
+			Namespace: obj.GetNamespace(),
+			Name:      ref.Name,
+		}
+
+		var (
+			data  []byte
+			found bool
+		)
+		switch ref.Kind {
+		case cueinstancev1a1.ConfigMapKind:
+			var cm corev1.ConfigMap
+			if err := r.Client.Get(ctx, namespacedName, &cm); err != nil {
+				return nil, fmt.Errorf("unable to get schema '%s': %w", ref.String(), err)
+			}
+			var s string
+			if s, found = cm.Data[ref.GetKey()]; found {
+				data = []byte(s)
+			} else {
+				data, found = cm.BinaryData[ref.GetKey()]
+			}
+		case cueinstancev1a1.SecretKind:
+			var secret corev1.Secret
+			if err := r.Client.Get(ctx, namespacedName, &secret); err != nil {
+				return nil, fmt.Errorf("unable to get schema '%s': %w", ref.String(), err)
+			}
+			data, found = secret.Data[ref.GetKey()]
+		default:
+			return nil, fmt.Errorf("schema `%s` kind '%s' not supported", ref.Name, ref.Kind)
+		}
+
+		if !found {
+			return nil, fmt.Errorf("schema key '%s' not found in %s '%s'", ref.GetKey(), ref.Kind, namespacedName)
+		}
+		schemas[ref.String()] = data
+	}
+
+	cueSchemas, err := r.getCueSchemas(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	fetched, err := r.fetchCueSchemas(ctx, obj, cueSchemas, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &validationSchemas{
+		refs:       schemas,
+		cueSchemas: fetched,
+	}, nil
+}
+
+// objectValidator validates the objects extracted from a CUE instance
+// against the validations of a CueInstance.
+type objectValidator struct {
+	r           *CueInstanceReconciler
+	obj         *cueinstancev1a1.CueInstance
+	revision    string
+	validations []compiledValidation
+	openAPI     *openAPISchemas
+	status      cueinstancev1a1.ValidationStatus
+	skipped     map[string]bool
+}
+
+type compiledValidation struct {
+	cueinstancev1a1.Validation
+	schema   cue.Value
+	selector labels.Selector
+}
+
+// newObjectValidator compiles the validations of the given CueInstance,
+// followed by the CueSchemas selecting it. Schema paths are looked up in
+// value, or in the referenced schema source which is compiled in the
+// context of value. The schemas of 'openapi' validations are looked up per
+// object in openAPI.
+func (r *CueInstanceReconciler) newObjectValidator(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance,
+	revision string,
+	value cue.Value,
+	schemas *validationSchemas,
+	openAPI *openAPISchemas) (*objectValidator, error) {
+	v := &objectValidator{
+		r:        r,
+		obj:      obj,
+		revision: revision,
+		openAPI:  openAPI,
+		skipped:  map[string]bool{},
+	}
+
+	for _, validation := range obj.GetValidations() {
+		cv := compiledValidation{Validation: validation}
+
+		switch validation.GetType() {
+		case cueinstancev1a1.CueValidationType, cueinstancev1a1.YamlValidationType:
+			schema, err := compileSchema(validation, value, schemas.refs)
+			if err != nil {
+				return nil, err
+			}
+			cv.schema = schema
+		case cueinstancev1a1.OpenAPIValidationType:
+			// the schema depends on the kind of each object
+		default:
+			return nil, fmt.Errorf("validation '%s': type '%s' not supported",
+				validation.GetName(), validation.GetType())
+		}
+
+		selector, err := objectLabelSelector(validation)
+		if err != nil {
+			return nil, err
+		}
+		cv.selector = selector
+
+		v.validations = append(v.validations, cv)
+	}
+
+	// A CueSchema whose schema is unavailable fails the build in 'Fail'
+	// mode, and is skipped otherwise.
+	for _, cs := range schemas.cueSchemas {
+		cv, err := cs.compile(value.Context())
+		if err != nil {
+			validation := cs.schema.GetValidation()
+			if validation.GetMode() == cueinstancev1a1.FailPolicy {
+				return nil, err
+			}
+			v.skip(ctx, validation, err)
+			continue
+		}
+		v.validations = append(v.validations, cv)
+	}
+
+	return v, nil
+}
+
+// objectLabelSelector returns the label selector of the objects of the
+// validation.
+func objectLabelSelector(validation cueinstancev1a1.Validation) (labels.Selector, error) {
+	if validation.Selector == nil || validation.Selector.LabelSelector == nil {
+		return labels.Everything(), nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(validation.Selector.LabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("validation '%s': invalid label selector: %w", validation.GetName(), err)
+	}
+	return selector, nil
+}
+
+// compileSchema returns the schema of a 'cue' or 'yaml' validation.
+func compileSchema(validation cueinstancev1a1.Validation,
+	value cue.Value,
+	schemas map[string][]byte) (cue.Value, error) {
+	root := value
+	if ref := validation.SchemaFrom; ref != nil {
+		root = value.Context().CompileBytes(schemas[ref.String()], cue.Filename(ref.String()))
+		if root.Err() != nil {
+			return cue.Value{}, fmt.Errorf("validation '%s': failed to compile schema: %s",
+				validation.GetName(), cueerrors.Details(root.Err(), nil))
+		}
+	}
+
+	return lookupSchema(validation, root)
+}
+
+// lookupSchema returns the schema of the validation within root, or root
+// itself if the validation has no schema path.
+func lookupSchema(validation cueinstancev1a1.Validation, root cue.Value) (cue.Value, error) {
+	if validation.Schema == "" {
+		return root, nil
+	}
+
+	path := cue.ParsePath(validation.Schema)
+	if path.Err() != nil {
+		return cue.Value{}, fmt.Errorf("validation '%s': invalid schema path '%s': %w",
+			validation.GetName(), validation.Schema, path.Err())
+	}
+	schema := root.LookupPath(path)
+	if !schema.Exists() {
+		return cue.Value{}, fmt.Errorf("validation '%s': schema '%s' not found",
+			validation.GetName(), validation.Schema)
+	}
+	return schema, nil
+}
+
+// validate returns the objects which are kept according to the mode of the
+// validations they fail, or an error naming the first object failing a
+// validation in 'Fail' mode.
+func (v *objectValidator) validate(ctx context.Context, objects []cue.Value) ([]cue.Value, error) {
+	if len(v.validations) == 0 {
+		return objects, nil
+	}
+
+	log := ctrl.LoggerFrom(ctx)
+	kept := make([]cue.Value, 0, len(objects))
+	for _, o := range objects {
+		checked, audited, keep := false, false, true
+		for _, cv := range v.validations {
+			if !cv.matches(o) {
+				continue
+			}
+
+			schema := cv.schema
+			if cv.GetType() == cueinstancev1a1.OpenAPIValidationType {
+				s, found, err := v.openAPI.schema(lookupString(o, "apiVersion"), lookupString(o, "kind"))
+				if err != nil {
+					if cv.GetMode() == cueinstancev1a1.FailPolicy {
+						return nil, err
+					}
+					v.skip(ctx, cv.Validation, err)
+					continue
+				}
+				if !found {
+					log.V(1).Info(fmt.Sprintf("no OpenAPI schema found for %s", objectID(o)))
+					continue
+				}
+				schema = s
+			}
+			checked = true
+
+			err := cv.check(schema, o)
+			if err == nil {
+				continue
+			}
+
+			result := cueinstancev1a1.NewValidationResult(objectID(o), cv.Validation,
+				errorPath(err), cueerrors.Details(err, nil))
+			msg := fmt.Sprintf("%s validation '%s' failed for %s: %s",
+				cv.GetType(), result.Validation, result.Object, result.Message)
+			if cv.GetMode() == cueinstancev1a1.IgnorePolicy {
+				log.Info(msg)
+				continue
+			}
+
+			v.record(result, msg)
+			switch cv.GetMode() {
+			case cueinstancev1a1.FailPolicy:
+				v.status.Checked++
+				return nil, errors.New(msg)
+			case cueinstancev1a1.DropPolicy:
+				keep = false
+			case cueinstancev1a1.AuditPolicy:
+				audited = true
+			}
+
+			if !keep {
+				break
+			}
+		}
+
+		if checked {
+			v.status.Checked++
+		}
+		switch {
+		case !keep:
+			v.status.Dropped++
+		case audited:
+			v.status.Audited++
+		}
+
+		if keep {
+			kept = append(kept, o)
+		}
+	}
+	return kept, nil
+}
+
+// record adds the result to the validation status and emits an event with
+// the result as metadata.
+func (v *objectValidator) record(result cueinstancev1a1.ValidationResult, msg string) {
+	if len(v.status.Results) < cueinstancev1a1.MaxValidationResults {
+		v.status.Results = append(v.status.Results, result)
+	}
+
+	severity := eventv1.EventSeverityError
+	if result.Mode == cueinstancev1a1.AuditPolicy {
+		severity = eventv1.EventSeverityInfo
+	}
+
+	group := cueinstancev1a1.GroupVersion.Group
+	metadata := map[string]string{
+		group + "/validation": result.Validation,
+		group + "/object":     result.Object,
+		group + "/mode":       string(result.Mode),
+	}
+	if result.Schema != "" {
+		metadata[group+"/schema"] = result.Schema
+	}
+	if result.Path != "" {
+		metadata[group+"/path"] = result.Path
+	}
+	v.r.event(v.obj, v.revision, severity, msg, metadata)
+}
+
+// skip records that a validation in a mode other than 'Fail' was skipped
+// because of an error with its schema, once per validation and error. The
+// error is logged in 'Ignore' mode, otherwise it is added to the validation
+// status and emitted as an event.
+func (v *objectValidator) skip(ctx context.Context, validation cueinstancev1a1.Validation, err error) {
+	schemaErr := cueinstancev1a1.NewValidationSchemaError(validation, err.Error())
+	key := schemaErr.Validation + "/" + schemaErr.Message
+	if v.skipped[key] {
+		return
+	}
+	v.skipped[key] = true
+
+	msg := fmt.Sprintf("%s validation '%s' skipped: %s",
+		validation.GetType(), schemaErr.Validation, schemaErr.Message)
+	if schemaErr.Mode == cueinstancev1a1.IgnorePolicy {
+		ctrl.LoggerFrom(ctx).Info(msg)
+		return
+	}
+
+	if len(v.status.SchemaErrors) < cueinstancev1a1.MaxValidationResults {
+		v.status.SchemaErrors = append(v.status.SchemaErrors, schemaErr)
+	}
+
+	severity := eventv1.EventSeverityError
+	if schemaErr.Mode == cueinstancev1a1.AuditPolicy {
+		severity = eventv1.EventSeverityInfo
+	}
+
+	group := cueinstancev1a1.GroupVersion.Group
+	metadata := map[string]string{
+		group + "/validation": schemaErr.Validation,
+		group + "/mode":       string(schemaErr.Mode),
+	}
+	if schemaErr.Schema != "" {
+		metadata[group+"/schema"] = schemaErr.Schema
+	}
+	v.r.event(v.obj, v.revision, severity, msg, metadata)
+}
+
+// summary returns the validation report of the validated objects, or nil
+// if the CueInstance has no validations.
+func (v *objectValidator) summary() *cueinstancev1a1.ValidationStatus {
+	if len(v.validations) == 0 && len(v.status.SchemaErrors) == 0 {
+		return nil
+	}
+	status := v.status
+	return &status
+}
+
+// setValidatedCondition sets the Validated condition of the CueInstance
+// according to its validation status, or removes it if there is none.
+func setValidatedCondition(obj *cueinstancev1a1.CueInstance) {
+	status := obj.Status.Validation
+	if status == nil {
+		conditions.Delete(obj, cueinstancev1a1.ValidatedCondition)
+		return
+	}
+
+	if len(status.Results) == 0 && len(status.SchemaErrors) > 0 {
+		conditions.MarkFalse(obj, cueinstancev1a1.ValidatedCondition, cueinstancev1a1.ValidationSchemaFailedReason,
+			"%d objects checked, %d schema errors, first: validation '%s': %s",
+			status.Checked, len(status.SchemaErrors),
+			status.SchemaErrors[0].Validation, status.SchemaErrors[0].Message)
+		return
+	}
+
+	if len(status.Results) == 0 {
+		conditions.MarkTrue(obj, cueinstancev1a1.ValidatedCondition, cueinstancev1a1.ValidationSucceededReason,
+			"%d objects passed validation", status.Checked)
+		return
+	}
+
+	conditions.MarkFalse(obj, cueinstancev1a1.ValidatedCondition, cueinstancev1a1.ValidationFailedReason,
+		"%d objects checked, %d dropped, %d audited, first failure: %s validation '%s': %s",
+		status.Checked, status.Dropped, status.Audited,
+		status.Results[0].Object, status.Results[0].Validation, status.Results[0].Message)
+}
+
+// matches reports whether the object is selected by the validation.
+func (cv compiledValidation) matches(o cue.Value) bool {
+	if cv.Selector == nil {
+		return true
+	}
+	if cv.Selector.APIVersion != "" && lookupString(o, "apiVersion") != cv.Selector.APIVersion {
+		return false
+	}
+	if cv.Selector.Kind != "" && lookupString(o, "kind") != cv.Selector.Kind {
+		return false
+	}
+
+	var objLabels map[string]string
+	if l := o.LookupPath(cue.ParsePath("metadata.labels")); l.Exists() {
+		if err := l.Decode(&objLabels); err != nil {
+			return false
+		}
+	}
+	return cv.selector.Matches(labels.Set(objLabels))
+}
+
+// check validates the object against the given schema, according to the
+// type of the validation.
+func (cv compiledValidation) check(schema, o cue.Value) error {
+	switch cv.GetType() {
+	case cueinstancev1a1.CueValidationType, cueinstancev1a1.OpenAPIValidationType:
+		return schema.Unify(o).Validate(cue.Concrete(true))
+	default:
+		data, err := yaml.Encode(o)
+		if err != nil {
+			return err
+		}
+		return yaml.Validate(data, schema)
+	}
+}
+
+// objectID returns the kind, namespace and name of an object, e.g.
+// 'Deployment/default/podinfo'.
+func objectID(o cue.Value) string {
+	kind := lookupString(o, "kind")
+	name := lookupString(o, "metadata.name")
+	if namespace := lookupString(o, "metadata.namespace"); namespace != "" {
+		return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+	}
+	return fmt.Sprintf("%s/%s", kind, name)
+}
+
+// errorPath returns the path of the first error in err, e.g.
+// 'spec.replicas'.
+func errorPath(err error) string {
+	errs := cueerrors.Errors(err)
+	if len(errs) == 0 {
+		return ""
+	}
+	return strings.Join(errs[0].Path(), ".")
+}
+
+func lookupString(v cue.Value, path string) string {
+	s, _ := v.LookupPath(cue.ParsePath(path)).String()
+	return s
+}
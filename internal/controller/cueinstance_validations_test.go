@@ -0,0 +1,606 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_Validations(t *testing.T) {
+	g := NewWithT(t)
+	id := "validations-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	schema := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "schemas",
+			Namespace: id,
+		},
+		Data: map[string]string{
+			"schema.cue": `metadata: labels: team: string`,
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), schema)).To(Succeed())
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Exprs: []string{
+				"objects",
+			},
+			Validations: []cueinstancev1a1.Validation{
+				{
+					Name:   "size",
+					Type:   cueinstancev1a1.CueValidationType,
+					Mode:   cueinstancev1a1.DropPolicy,
+					Schema: "schemas.config",
+					Selector: &cueinstancev1a1.ObjectSelector{
+						Kind: "ConfigMap",
+					},
+				},
+				{
+					Name: "team",
+					Type: cueinstancev1a1.CueValidationType,
+					Mode: cueinstancev1a1.AuditPolicy,
+					SchemaFrom: &cueinstancev1a1.SchemaReference{
+						Kind: cueinstancev1a1.ConfigMapKind,
+						Name: "schemas",
+					},
+				},
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+schemas: config: data: size: "small" | "large"
+
+objects: [
+	{
+		apiVersion: "v1"
+		kind:       "ConfigMap"
+		metadata: {
+			name:      "valid"
+			namespace: %[1]q
+		}
+		data: size: "small"
+	},
+	{
+		apiVersion: "v1"
+		kind:       "ConfigMap"
+		metadata: {
+			name:      "invalid"
+			namespace: %[1]q
+		}
+		data: size: "huge"
+	},
+	{
+		apiVersion: "v1"
+		kind:       "ServiceAccount"
+		metadata: {
+			name:      "account"
+			namespace: %[1]q
+		}
+	},
+]
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj cueinstancev1a1.CueInstance
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "valid",
+		Namespace: id,
+	}, &corev1.ConfigMap{})).To(Succeed())
+
+	// Objects failing an audited validation are applied.
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "account",
+		Namespace: id,
+	}, &corev1.ServiceAccount{})).To(Succeed())
+
+	// Objects failing a validation in 'Drop' mode are not applied.
+	err = k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "invalid",
+		Namespace: id,
+	}, &corev1.ConfigMap{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestCueInstanceReconciler_ValidationsWholeInstance(t *testing.T) {
+	g := NewWithT(t)
+	id := "validations-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Validations: []cueinstancev1a1.Validation{
+				{
+					Name:   "size",
+					Type:   cueinstancev1a1.CueValidationType,
+					Mode:   cueinstancev1a1.DropPolicy,
+					Schema: "#Config",
+					Selector: &cueinstancev1a1.ObjectSelector{
+						Kind: "ConfigMap",
+					},
+				},
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+#Config: data: size: "small" | "large"
+
+valid: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "valid"
+		namespace: %[1]q
+	}
+	data: size: "small"
+}
+
+invalid: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "invalid"
+		namespace: %[1]q
+	}
+	data: size: "huge"
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(obj.Status.Validation).NotTo(BeNil())
+	g.Expect(obj.Status.Validation.Checked).To(Equal(2))
+	g.Expect(obj.Status.Validation.Dropped).To(Equal(1))
+	g.Expect(obj.Status.Validation.Audited).To(Equal(0))
+
+	g.Expect(obj.Status.Validation.Results).To(HaveLen(1))
+	result := obj.Status.Validation.Results[0]
+	g.Expect(result.Object).To(Equal(fmt.Sprintf("ConfigMap/%s/invalid", id)))
+	g.Expect(result.Validation).To(Equal("size"))
+	g.Expect(result.Schema).To(Equal("#Config"))
+	g.Expect(result.Mode).To(Equal(cueinstancev1a1.DropPolicy))
+	g.Expect(result.Path).To(HaveSuffix("data.size"))
+
+	validated := conditions.Get(&obj, cueinstancev1a1.ValidatedCondition)
+	g.Expect(validated).NotTo(BeNil())
+	g.Expect(validated.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(validated.Reason).To(Equal(cueinstancev1a1.ValidationFailedReason))
+
+	// The valid objects of the instance are applied.
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "valid",
+		Namespace: id,
+	}, &corev1.ConfigMap{})).To(Succeed())
+
+	err = k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "invalid",
+		Namespace: id,
+	}, &corev1.ConfigMap{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestCueInstanceReconciler_ValidationsOpenAPI(t *testing.T) {
+	g := NewWithT(t)
+	id := "validations-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	cueInstanceKey := types.NamespacedName{
+		Name:      "inst-" + randStringRunes(5),
+		Namespace: id,
+	}
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cueInstanceKey.Name,
+			Namespace: cueInstanceKey.Namespace,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Validations: []cueinstancev1a1.Validation{
+				{
+					Type: cueinstancev1a1.OpenAPIValidationType,
+					Mode: cueinstancev1a1.DropPolicy,
+				},
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+valid: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "valid"
+		namespace: %[1]q
+	}
+	data: key: "value"
+}
+
+typo: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "typo"
+		namespace: %[1]q
+	}
+	dataa: key: "value"
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(obj.Status.Validation).NotTo(BeNil())
+	g.Expect(obj.Status.Validation.Dropped).To(Equal(1))
+	g.Expect(obj.Status.Validation.Results).To(HaveLen(1))
+	g.Expect(obj.Status.Validation.Results[0].Object).To(Equal(fmt.Sprintf("ConfigMap/%s/typo", id)))
+	g.Expect(obj.Status.Validation.Results[0].Path).To(HaveSuffix("dataa"))
+
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "valid",
+		Namespace: id,
+	}, &corev1.ConfigMap{})).To(Succeed())
+
+	// Fields unknown to the API server are reported instead of pruned.
+	err = k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "typo",
+		Namespace: id,
+	}, &corev1.ConfigMap{})
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestCueInstanceReconciler_ValidationsOpenAPICRD(t *testing.T) {
+	g := NewWithT(t)
+	id := "validations-" + randStringRunes(5)
+	group := id + ".example.com"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	sizeSchema := func(typ string) *apiextensionsv1.CustomResourceValidation {
+		return &apiextensionsv1.CustomResourceValidation{
+			OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+				Type: "object",
+				Properties: map[string]apiextensionsv1.JSONSchemaProps{
+					"spec": {
+						Type: "object",
+						Properties: map[string]apiextensionsv1.JSONSchemaProps{
+							"size": {Type: typ},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	crd := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "widgets." + group,
+		},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Kind:     "Widget",
+				ListKind: "WidgetList",
+				Plural:   "widgets",
+				Singular: "widget",
+			},
+			Scope: apiextensionsv1.NamespaceScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{
+					Name:    "v1",
+					Served:  true,
+					Storage: true,
+					Schema:  sizeSchema("integer"),
+				},
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), crd)).To(Succeed())
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(crd), crd)
+		for _, c := range crd.Status.Conditions {
+			if c.Type == apiextensionsv1.Established {
+				return c.Status == apiextensionsv1.ConditionTrue
+			}
+		}
+		return false
+	}, timeout, time.Second).Should(BeTrue())
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "inst-" + randStringRunes(5),
+			Namespace: id,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Validations: []cueinstancev1a1.Validation{
+				{
+					Type: cueinstancev1a1.OpenAPIValidationType,
+					Mode: cueinstancev1a1.FailPolicy,
+				},
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+widget: {
+	apiVersion: "%s/v1"
+	kind:       "Widget"
+	metadata: {
+		name:      "widget"
+		namespace: %q
+	}
+	spec: size: 3
+}
+`, group, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	// The custom resource is checked against the schema of the CRD once
+	// the API server publishes it.
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj) &&
+			obj.Status.Validation != nil && obj.Status.Validation.Checked == 1
+	}, timeout, time.Second).Should(BeTrue())
+
+	// The new schema of the CRD is enforced once it changes.
+	g.Eventually(func() error {
+		if err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(crd), crd); err != nil {
+			return err
+		}
+		crd.Spec.Versions[0].Schema = sizeSchema("string")
+		return k8sClient.Update(context.TODO(), crd)
+	}, timeout, time.Second).Should(Succeed())
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.IsFalse(&obj, meta.ReadyCondition) &&
+			strings.Contains(conditions.GetMessage(&obj, meta.ReadyCondition),
+				fmt.Sprintf("failed for Widget/%s/widget", id))
+	}, timeout, time.Second).Should(BeTrue())
+}
+
+func TestCueInstanceReconciler_ValidationsOpenAPIUnavailable(t *testing.T) {
+	g := NewWithT(t)
+	id := "validations-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	// The target cluster is reached through a proxy which does not serve
+	// the OpenAPI v3 schemas.
+	transport, err := rest.TransportFor(testEnv.Config)
+	g.Expect(err).NotTo(HaveOccurred())
+	target, _, err := rest.DefaultServerURL(testEnv.Config.Host, "", schema.GroupVersion{}, true)
+	g.Expect(err).NotTo(HaveOccurred())
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/openapi/v3") {
+			http.Error(w, "OpenAPI v3 is not served", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	proxyKubeConfig, err := clientcmd.Write(clientcmdapi.Config{
+		Clusters: map[string]*clientcmdapi.Cluster{
+			"proxy": {Server: server.URL},
+		},
+		AuthInfos: map[string]*clientcmdapi.AuthInfo{
+			"proxy": {},
+		},
+		Contexts: map[string]*clientcmdapi.Context{
+			"proxy": {Cluster: "proxy", AuthInfo: "proxy"},
+		},
+		CurrentContext: "proxy",
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(k8sClient.Create(context.TODO(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kubeconfig",
+			Namespace: id,
+		},
+		Data: map[string][]byte{
+			"value.yaml": proxyKubeConfig,
+		},
+	})).To(Succeed())
+
+	cueInstance := &cueinstancev1a1.CueInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "inst-" + randStringRunes(5),
+			Namespace: id,
+		},
+		Spec: cueinstancev1a1.CueInstanceSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Validations: []cueinstancev1a1.Validation{
+				{
+					Type: cueinstancev1a1.OpenAPIValidationType,
+					Mode: cueinstancev1a1.AuditPolicy,
+				},
+			},
+			Inline: []cueinstancev1a1.InlineFile{
+				{
+					Name: "main.cue",
+					Content: fmt.Sprintf(`package main
+
+config: {
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "config"
+		namespace: %q
+	}
+	data: key: "value"
+}
+`, id),
+				},
+			},
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+	// In 'Audit' mode the validation is skipped and the objects applied.
+	var obj cueinstancev1a1.CueInstance
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return isReconcileSuccess(&obj)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(obj.Status.Validation).NotTo(BeNil())
+	g.Expect(obj.Status.Validation.Checked).To(Equal(0))
+	g.Expect(obj.Status.Validation.SchemaErrors).To(HaveLen(1))
+	g.Expect(obj.Status.Validation.SchemaErrors[0].Mode).To(Equal(cueinstancev1a1.AuditPolicy))
+	g.Expect(obj.Status.Validation.SchemaErrors[0].Message).To(ContainSubstring("failed to discover the OpenAPI schemas"))
+	g.Expect(conditions.GetReason(&obj, cueinstancev1a1.ValidatedCondition)).
+		To(Equal(cueinstancev1a1.ValidationSchemaFailedReason))
+
+	g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+		Name:      "config",
+		Namespace: id,
+	}, &corev1.ConfigMap{})).To(Succeed())
+
+	// In 'Fail' mode the build fails.
+	obj.Spec.Validations[0].Mode = cueinstancev1a1.FailPolicy
+	g.Expect(k8sClient.Update(context.TODO(), &obj)).To(Succeed())
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+		return conditions.IsFalse(&obj, meta.ReadyCondition) &&
+			conditions.GetObservedGeneration(&obj, meta.ReadyCondition) == obj.Generation
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(conditions.GetMessage(&obj, meta.ReadyCondition)).
+		To(ContainSubstring("failed to discover the OpenAPI schemas"))
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"cuelang.org/go/cue"
+	cueerrors "cuelang.org/go/cue/errors"
+	"cuelang.org/go/encoding/yaml"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// valuesDocument is a YAML or JSON document which is unified into the CUE
+// instance at the values path.
+type valuesDocument struct {
+	// name is used as the file name in the positions of CUE errors.
+	name string
+	data []byte
+}
+
+// getValues collects the values of the given CueInstance, in order of the
+// ValuesFrom references followed by the inline Values. The outputs of a
+// CueInstance are only available when it is listed in dependsOn.
+func (r *CueInstanceReconciler) getValues(ctx context.Context,
+	obj *cueinstancev1a1.CueInstance) ([]valuesDocument, error) {
+	var docs []valuesDocument
+
+	for _, v := range obj.Spec.ValuesFrom {
+		namespacedName := types.NamespacedName{
+			Namespace: obj.GetNamespace(),
+			Name:      v.Name,
+		}
+
+		var (
+			data  []byte
+			found bool
+		)
+		switch v.Kind {
+		case cueinstancev1a1.ConfigMapKind:
+			var cm corev1.ConfigMap
+			if err := r.Client.Get(ctx, namespacedName, &cm); err != nil {
+				if apierrors.IsNotFound(err) && v.Optional {
+					continue
+				}
+				return nil, fmt.Errorf("unable to get values '%s': %w", v.String(), err)
+			}
+			var s string
+			if s, found = cm.Data[v.GetValuesKey()]; found {
+				data = []byte(s)
+			} else {
+				data, found = cm.BinaryData[v.GetValuesKey()]
+			}
+		case cueinstancev1a1.CueInstanceKind:
+			outputs, err := r.getDependencyOutputs(ctx, obj, namespacedName)
+			if err != nil {
+				if apierrors.IsNotFound(err) && v.Optional {
+					continue
+				}
+				return nil, fmt.Errorf("unable to get values '%s': %w", v.String(), err)
+			}
+			if key := v.GetValuesKey(); key != "" {
+				var output apiextensionsv1.JSON
+				if output, found = outputs[key]; found {
+					data = output.Raw
+				}
+				break
+			}
+			if data, err = json.Marshal(outputs); err != nil {
+				return nil, err
+			}
+			found = true
+		case cueinstancev1a1.SecretKind:
+			var secret corev1.Secret
+			if err := r.Client.Get(ctx, namespacedName, &secret); err != nil {
+				if apierrors.IsNotFound(err) && v.Optional {
+					continue
+				}
+				return nil, fmt.Errorf("unable to get values '%s': %w", v.String(), err)
+			}
+			data, found = secret.Data[v.GetValuesKey()]
+		default:
+			return nil, fmt.Errorf("values `%s` kind '%s' not supported", v.Name, v.Kind)
+		}
+
+		if !found {
+			if v.Optional {
+				continue
+			}
+			return nil, fmt.Errorf("values key '%s' not found in %s '%s'", v.GetValuesKey(), v.Kind, namespacedName)
+		}
+
+		docs = append(docs, valuesDocument{name: v.String(), data: data})
+	}
+
+	if obj.Spec.Values != nil && len(obj.Spec.Values.Raw) > 0 {
+		docs = append(docs, valuesDocument{name: "spec.values", data: obj.Spec.Values.Raw})
+	}
+
+	return docs, nil
+}
+
+// unifyValues unifies the given documents into value at the values path of
+// the CueInstance. Conflicts are reported with the positions of the
+// conflicting fields.
+func unifyValues(obj *cueinstancev1a1.CueInstance, value cue.Value, docs []valuesDocument) (cue.Value, error) {
+	if len(docs) == 0 {
+		return value, nil
+	}
+
+	path := cue.ParsePath(obj.GetValuesPath())
+	if path.Err() != nil {
+		return value, fmt.Errorf("invalid values path '%s': %w", obj.GetValuesPath(), path.Err())
+	}
+
+	for _, doc := range docs {
+		expr, err := yaml.Extract(doc.name, doc.data)
+		if err != nil {
+			return value, fmt.Errorf("failed to decode values from '%s': %s", doc.name, cueerrors.Details(err, nil))
+		}
+
+		v := value.Context().BuildFile(expr)
+		if v.Err() != nil {
+			return value, fmt.Errorf("failed to build values from '%s': %s", doc.name, cueerrors.Details(v.Err(), nil))
+		}
+
+		value = value.FillPath(path, v)
+	}
+
+	if err := value.LookupPath(path).Validate(); err != nil {
+		return value, fmt.Errorf("values unification failed at '%s': %s", obj.GetValuesPath(), cueerrors.Details(err, nil))
+	}
+
+	return value, nil
+}
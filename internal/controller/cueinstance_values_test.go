@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCueInstanceReconciler_Values(t *testing.T) {
+	g := NewWithT(t)
+	id := "values-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	artifactFile := "instance-" + randStringRunes(5)
+	artifactChecksum, err := createArtifact(testServer, "testdata/values", artifactFile)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      randStringRunes(5),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifactFile, "main/"+artifactChecksum)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	valuesCM := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "values",
+			Namespace: id,
+		},
+		Data: map[string]string{
+			"values.yaml": fmt.Sprintf("namespace: %s\nreplicas: 3\n", id),
+		},
+	}
+	g.Expect(k8sClient.Create(context.TODO(), valuesCM)).To(Succeed())
+
+	newInstance := func(values string) *cueinstancev1a1.CueInstance {
+		return &cueinstancev1a1.CueInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "inst-" + randStringRunes(5),
+				Namespace: id,
+			},
+			Spec: cueinstancev1a1.CueInstanceSpec{
+				Interval: metav1.Duration{Duration: reconciliationInterval},
+				Root:     "./testdata/values",
+				Exprs: []string{
+					"out",
+				},
+				Values: &apiextensionsv1.JSON{Raw: []byte(values)},
+				ValuesFrom: []cueinstancev1a1.ValuesReference{
+					{
+						Kind: cueinstancev1a1.ConfigMapKind,
+						Name: valuesCM.Name,
+					},
+					{
+						Kind:     cueinstancev1a1.SecretKind,
+						Name:     "missing",
+						Optional: true,
+					},
+				},
+				KubeConfig: &meta.KubeConfigReference{
+					SecretRef: meta.SecretKeyReference{
+						Name: "kubeconfig",
+					},
+				},
+				SourceRef: &cueinstancev1a1.CrossNamespaceSourceReference{
+					Name:      repositoryName.Name,
+					Namespace: repositoryName.Namespace,
+					Kind:      sourcev1.GitRepositoryKind,
+				},
+			},
+		}
+	}
+
+	t.Run("unifies values at the values path", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cueInstance := newInstance(`{"name": "hosts", "hosts": ["a.example.com", "b.example.com"]}`)
+		g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+		g.Eventually(func() bool {
+			var obj cueinstancev1a1.CueInstance
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+			return obj.Status.LastAppliedRevision == "main/"+artifactChecksum
+		}, timeout, time.Second).Should(BeTrue())
+
+		cm := &corev1.ConfigMap{}
+		g.Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+			Name:      "hosts",
+			Namespace: id,
+		}, cm)).To(Succeed())
+		g.Expect(cm.Data).To(HaveKeyWithValue("hosts", "a.example.com,b.example.com"))
+		g.Expect(cm.Data).To(HaveKeyWithValue("replicas", "3"))
+	})
+
+	t.Run("reports conflicts as build failures", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cueInstance := newInstance(`{"name": "conflict", "hosts": [], "replicas": "three"}`)
+		g.Expect(k8sClient.Create(context.TODO(), cueInstance)).To(Succeed())
+
+		var obj cueinstancev1a1.CueInstance
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cueInstance), &obj)
+			return isReconcileFailure(&obj)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.GetReason(&obj, meta.ReadyCondition)).To(Equal(cueinstancev1a1.BuildFailedReason))
+		g.Expect(conditions.GetMessage(&obj, meta.ReadyCondition)).To(ContainSubstring("spec.values"))
+	})
+}
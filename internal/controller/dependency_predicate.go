@@ -0,0 +1,61 @@
+package controller
+
+import (
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// DependencyReadyPredicate triggers an event when a CueInstance becomes
+// Ready, or is Ready at a new revision. A CueInstance is only considered on
+// creation if it is already Ready, and never on deletion.
+type DependencyReadyPredicate struct {
+	predicate.Funcs
+}
+
+func (DependencyReadyPredicate) Create(e event.CreateEvent) bool {
+	obj, ok := e.Object.(*cueinstancev1a1.CueInstance)
+	if !ok {
+		return false
+	}
+	return isReady(obj)
+}
+
+func (DependencyReadyPredicate) Delete(e event.DeleteEvent) bool {
+	return false
+}
+
+func (DependencyReadyPredicate) Generic(e event.GenericEvent) bool {
+	return false
+}
+
+func (DependencyReadyPredicate) Update(e event.UpdateEvent) bool {
+	if e.ObjectOld == nil || e.ObjectNew == nil {
+		return false
+	}
+
+	oldObj, ok := e.ObjectOld.(*cueinstancev1a1.CueInstance)
+	if !ok {
+		return false
+	}
+
+	newObj, ok := e.ObjectNew.(*cueinstancev1a1.CueInstance)
+	if !ok {
+		return false
+	}
+
+	if !isReady(newObj) {
+		return false
+	}
+
+	return !isReady(oldObj) || oldObj.Status.LastAppliedRevision != newObj.Status.LastAppliedRevision
+}
+
+func isReady(obj *cueinstancev1a1.CueInstance) bool {
+	return obj.Generation == obj.Status.ObservedGeneration &&
+		apimeta.IsStatusConditionTrue(obj.Status.Conditions, meta.ReadyCondition)
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// InlineSourceKind is the kind reported for CUE files embedded in the
+// CueInstance spec.
+const InlineSourceKind = "Inline"
+
+// localSource implements sourcev1.Source for files which are not served as
+// an artifact by source-controller, i.e. the files embedded in the
+// CueInstance spec or the keys of a ConfigMap or Secret.
+type localSource struct {
+	metav1.TypeMeta
+
+	files    map[string][]byte
+	interval time.Duration
+	artifact *sourcev1.Artifact
+}
+
+// newInlineSource returns a source for the inline files of the given
+// CueInstance, with a revision derived from a hash of the file contents.
+func newInlineSource(obj *cueinstancev1a1.CueInstance) *localSource {
+	files := make(map[string][]byte, len(obj.Spec.Inline))
+	for _, f := range obj.Spec.Inline {
+		files[f.Name] = []byte(f.Content)
+	}
+	digest := digestFiles(files)
+	return newLocalSource(InlineSourceKind, files,
+		fmt.Sprintf("%s@%s", InlineSourceKind, digest), digest, obj.Spec.Interval.Duration)
+}
+
+// newConfigMapSource returns a source for the keys of the given ConfigMap,
+// with a revision derived from its resource version.
+func newConfigMapSource(cm *corev1.ConfigMap, interval time.Duration) *localSource {
+	files := make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+	for k, v := range cm.Data {
+		files[k] = []byte(v)
+	}
+	for k, v := range cm.BinaryData {
+		files[k] = v
+	}
+	return newLocalSource(cueinstancev1a1.ConfigMapKind, files,
+		resourceVersionRevision(cm), digestFiles(files), interval)
+}
+
+// newSecretSource returns a source for the keys of the given Secret,
+// with a revision derived from its resource version.
+func newSecretSource(secret *corev1.Secret, interval time.Duration) *localSource {
+	files := make(map[string][]byte, len(secret.Data))
+	for k, v := range secret.Data {
+		files[k] = v
+	}
+	return newLocalSource(cueinstancev1a1.SecretKind, files,
+		resourceVersionRevision(secret), digestFiles(files), interval)
+}
+
+func newLocalSource(kind string, files map[string][]byte, revision, digest string, interval time.Duration) *localSource {
+	return &localSource{
+		TypeMeta: metav1.TypeMeta{Kind: kind},
+		files:    files,
+		interval: interval,
+		artifact: &sourcev1.Artifact{
+			Revision:       revision,
+			Digest:         digest,
+			LastUpdateTime: metav1.Now(),
+		},
+	}
+}
+
+// GetRequeueAfter returns the interval of the owning CueInstance.
+func (in *localSource) GetRequeueAfter() time.Duration {
+	return in.interval
+}
+
+// GetArtifact returns the artifact computed from the files.
+func (in *localSource) GetArtifact() *sourcev1.Artifact {
+	return in.artifact
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *localSource) DeepCopyObject() runtime.Object {
+	out := &localSource{
+		TypeMeta: in.TypeMeta,
+		interval: in.interval,
+		artifact: in.artifact.DeepCopy(),
+	}
+	out.files = make(map[string][]byte, len(in.files))
+	for k, v := range in.files {
+		out.files[k] = append([]byte(nil), v...)
+	}
+	return out
+}
+
+// writeTo writes the files into the given directory.
+func (in *localSource) writeTo(dir string) error {
+	return writeFiles(dir, in.files)
+}
+
+// writeFiles writes the given files into dir, creating any missing parent
+// directories. File names are resolved securely relative to dir.
+func writeFiles(dir string, files map[string][]byte) error {
+	for name, data := range files {
+		path, err := securejoin.SecureJoin(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("failed to create dir for file '%s': %w", name, err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return fmt.Errorf("failed to write file '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// digestFiles returns the sha256 digest of the given files, computed over
+// the names and contents in lexical order.
+func digestFiles(files map[string][]byte) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%s\x00", name, files[name])
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
+
+func resourceVersionRevision(obj metav1.Object) string {
+	return fmt.Sprintf("%s@rv:%s", obj.GetName(), obj.GetResourceVersion())
+}
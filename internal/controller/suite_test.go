@@ -32,11 +32,16 @@ import (
 
 	"github.com/opencontainers/go-digest"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlcache "sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlcfg "sigs.k8s.io/controller-runtime/pkg/config"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	controllerLog "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
@@ -59,6 +64,11 @@ const (
 	interval               = time.Second * 1
 	reconciliationInterval = time.Second * 5
 	vaultVersion           = "1.13.2"
+	controllerName         = "cue-flux-controller"
+
+	// testReconcilerLabel selects the CueInstances reconciled by a dedicated
+	// test reconciler, which the reconciler of the suite ignores.
+	testReconcilerLabel = "cue.contrib.flux.io/test-reconciler"
 )
 
 var (
@@ -79,6 +89,7 @@ func runInContext(registerControllers func(*testenv.Environment), run func() int
 	utilruntime.Must(cueinstancev1a1.AddToScheme(scheme.Scheme))
 	utilruntime.Must(sourcev1.AddToScheme(scheme.Scheme))
 	utilruntime.Must(sourcev1b2.AddToScheme(scheme.Scheme))
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme.Scheme))
 
 	if debugMode {
 		controllerLog.SetLogger(zap.New(zap.WriteTo(os.Stderr), zap.UseDevMode(false)))
@@ -89,6 +100,25 @@ func runInContext(registerControllers func(*testenv.Environment), run func() int
 		testenv.WithMaxConcurrentReconciles(4),
 	)
 
+	// Replace the manager of the environment by one which ignores the
+	// CueInstances of the dedicated test reconcilers.
+	testEnv.Manager, err = ctrl.NewManager(testEnv.Config, ctrl.Options{
+		Scheme:             scheme.Scheme,
+		MetricsBindAddress: "0",
+		Controller: ctrlcfg.Controller{
+			MaxConcurrentReconciles: 4,
+		},
+		Cache: ctrlcache.Options{
+			ByObject: map[client.Object]ctrlcache.ByObject{
+				&cueinstancev1a1.CueInstance{}: {Label: testReconcilerSelector(selection.DoesNotExist)},
+			},
+		},
+	})
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create the test environment manager: %v", err))
+	}
+	testEnv.Client = testEnv.Manager.GetClient()
+
 	testServer, err = testserver.NewTempArtifactServer()
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create a temporary storage server: %v", err))
@@ -153,7 +183,6 @@ func runInContext(registerControllers func(*testenv.Environment), run func() int
 
 func TestMain(m *testing.M) {
 	code := runInContext(func(testEnv *testenv.Environment) {
-		controllerName := "cue-flux-controller"
 		testMetricsH = controller.MustMakeMetrics(testEnv)
 		kstatusCheck = kcheck.NewChecker(testEnv.Client,
 			&kcheck.Conditions{
@@ -167,6 +196,7 @@ func TestMain(m *testing.M) {
 		kstatusInProgressCheck.DisableFetch = true
 		reconciler = &CueInstanceReconciler{
 			ControllerName: controllerName,
+			ClusterName:    "testenv",
 			Client:         testEnv,
 			EventRecorder:  testEnv.GetEventRecorderFor(controllerName),
 			Metrics:        testMetricsH,
@@ -181,6 +211,64 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// startTestReconciler runs a reconciler configured by the given function in
+// a dedicated manager, which only reconciles the CueInstances labelled with
+// testReconcilerLabel set to name. This lets a test change the settings of
+// the reconciler without racing with, or affecting, the one of the suite.
+func startTestReconciler(t *testing.T, name string, opts CueInstanceReconcilerOptions,
+	configure func(r *CueInstanceReconciler)) ctrl.Manager {
+	t.Helper()
+
+	mgr, err := ctrl.NewManager(testEnv.Config, ctrl.Options{
+		Scheme:             scheme.Scheme,
+		MetricsBindAddress: "0",
+		Cache: ctrlcache.Options{
+			ByObject: map[client.Object]ctrlcache.ByObject{
+				&cueinstancev1a1.CueInstance{}: {Label: testReconcilerSelector(selection.Equals, name)},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create the test reconciler manager: %v", err)
+	}
+
+	r := &CueInstanceReconciler{
+		ControllerName: controllerName,
+		ClusterName:    "testenv",
+		Client:         mgr.GetClient(),
+		EventRecorder:  mgr.GetEventRecorderFor(controllerName),
+		Metrics:        testMetricsH,
+	}
+	if configure != nil {
+		configure(r)
+	}
+	if err := r.SetupWithManager(ctx, mgr, opts); err != nil {
+		t.Fatalf("failed to set up the test reconciler: %v", err)
+	}
+
+	mgrCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := mgr.Start(mgrCtx); err != nil {
+			t.Errorf("failed to start the test reconciler manager: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return mgr
+}
+
+func testReconcilerSelector(op selection.Operator, values ...string) labels.Selector {
+	req, err := labels.NewRequirement(testReconcilerLabel, op, values)
+	if err != nil {
+		panic(err)
+	}
+	return labels.NewSelector().Add(*req)
+}
+
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyz1234567890")
 
 func randStringRunes(n int) string {
@@ -0,0 +1,23 @@
+package main
+
+_name:      string @tag(name,var=cueinstance_name)
+_namespace: string @tag(namespace,var=cueinstance_namespace)
+_revision:  string @tag(revision,var=flux_revision)
+_source:    string @tag(source,var=flux_source_name)
+_cluster:   string @tag(cluster,var=cluster_name)
+_version:   string @tag(version,var=kubernetes_version)
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      _name
+		namespace: _namespace
+	}
+	data: {
+		revision: _revision
+		source:   _source
+		cluster:  _cluster
+		version:  _version
+	}
+}]
@@ -0,0 +1,24 @@
+package main
+
+import "strings"
+
+_namespace: string @tag(namespace)
+_replicas:  int    @tag(replicas,type=int)
+_enabled:   bool   @tag(enabled,var=enabled)
+_weight:    number @tag(weight,var=weight)
+_ports: [...int] @tag(ports,var=ports)
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      "typed"
+		namespace: _namespace
+	}
+	data: {
+		replicas: "\(_replicas + 1)"
+		enabled:  "\(!_enabled)"
+		weight:   "\(_weight * 2)"
+		ports:    strings.Join([ for p in _ports {"\(p)"}], ",")
+	}
+}]
@@ -0,0 +1,23 @@
+package main
+
+import "strings"
+
+values: {
+	name:      string
+	namespace: string
+	hosts: [...string]
+	replicas: int
+}
+
+out: [{
+	apiVersion: "v1"
+	kind:       "ConfigMap"
+	metadata: {
+		name:      values.name
+		namespace: values.namespace
+	}
+	data: {
+		hosts:    strings.Join(values.hosts, ",")
+		replicas: "\(values.replicas)"
+	}
+}]
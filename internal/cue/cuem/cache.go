@@ -0,0 +1,447 @@
+package cuem
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/mod/sumdb/dirhash"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+const (
+	// CacheHitEvent is recorded when a module is found in the cache.
+	CacheHitEvent = "cache_hit"
+	// CacheMissEvent is recorded when a module is not found in the cache.
+	CacheMissEvent = "cache_miss"
+)
+
+var cacheEventsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cue_dependency_cache_events_total",
+		Help: "Total number of lookups of CUE module dependencies in the cache, by event type.",
+	},
+	[]string{"event_type"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(cacheEventsCounter)
+}
+
+// entryHashFile is the file of a cache entry holding the hash of the other
+// files of the entry, which is checked before they are restored.
+const entryHashFile = ".hash"
+
+// Module is a version of a module dependency, with its checksum.
+type Module struct {
+	cueinstancev1a1.ModuleVersion
+
+	// Sum is the checksum of the module, a cache entry is only restored for
+	// the checksum it was stored with. Modules without a checksum are not
+	// cached.
+	Sum string
+}
+
+// cacheVendorDirs are the directories of cue.mod into which cuemod vendors
+// the files of a module, 'pkg' for CUE modules and 'gen' for the CUE
+// definitions generated from Go modules.
+var cacheVendorDirs = []string{"pkg", "gen"}
+
+// Cache is an on-disk cache of the resolved dependencies of CUE modules,
+// keyed by module path, version and checksum and shared by the reconciles of
+// the controller. Each entry holds the CUE files vendored for a module, and the
+// least recently used entries are evicted when the cache exceeds its size.
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	// files guards the entries on disk, which are only removed while it is
+	// held for writing.
+	files sync.RWMutex
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// NewCache returns a cache in dir holding at most maxSize bytes, with the
+// entries left in dir by a previous run.
+func NewCache(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		cacheEntry
+		modTime time.Time
+	}
+	var found []entry
+	for _, item := range items {
+		path := filepath.Join(dir, item.Name())
+		// Entries which were being written when the controller stopped.
+		if strings.HasPrefix(item.Name(), ".") || !item.IsDir() {
+			if err := os.RemoveAll(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		info, err := item.Info()
+		if err != nil {
+			return nil, err
+		}
+		size, err := dirSize(path)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, entry{cacheEntry{key: item.Name(), size: size}, info.ModTime()})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.Before(found[j].modTime)
+	})
+	for _, e := range found {
+		c.entries[e.key] = c.lru.PushFront(&cacheEntry{key: e.key, size: e.size})
+		c.size += e.size
+	}
+	c.evict()
+
+	return c, nil
+}
+
+// Restore copies the cached files of the given modules into the cue.mod
+// directory of the module in moduleRootPath, and reports whether all of
+// them were found. The entries whose files do not match their hash are
+// removed from the cache, and reported as not found. Modules without a
+// checksum are refused.
+func (c *Cache) Restore(modules []Module, moduleRootPath string) (bool, error) {
+	if err := checkSums(modules); err != nil {
+		return false, err
+	}
+
+	found, corrupted, err := c.restore(modules, moduleRootPath)
+	for _, key := range corrupted {
+		c.remove(key)
+	}
+	return found, err
+}
+
+func (c *Cache) restore(modules []Module, moduleRootPath string) (bool, []string, error) {
+	c.files.RLock()
+	defer c.files.RUnlock()
+
+	found := true
+	var corrupted []string
+	for _, m := range modules {
+		key := cacheKey(m)
+		if !c.touch(key) {
+			cacheEventsCounter.WithLabelValues(CacheMissEvent).Inc()
+			found = false
+			continue
+		}
+
+		if ok, err := verifyEntry(filepath.Join(c.dir, key)); err != nil || !ok {
+			cacheEventsCounter.WithLabelValues(CacheMissEvent).Inc()
+			corrupted = append(corrupted, key)
+			found = false
+			continue
+		}
+		cacheEventsCounter.WithLabelValues(CacheHitEvent).Inc()
+
+		if !found {
+			continue
+		}
+		for _, d := range cacheVendorDirs {
+			src := filepath.Join(c.dir, key, d)
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				continue
+			}
+			if err := copyCueFiles(src, filepath.Join(moduleRootPath, "cue.mod", d)); err != nil {
+				return false, corrupted, fmt.Errorf("failed to restore module '%s@%s' from the cache: %w", m.Module, m.Version, err)
+			}
+		}
+	}
+	return found, corrupted, nil
+}
+
+// Store adds the files vendored for the given modules in the cue.mod
+// directory of the module in moduleRootPath to the cache, unless they are
+// already cached. Modules without a checksum are refused.
+func (c *Cache) Store(modules []Module, moduleRootPath string) error {
+	if err := checkSums(modules); err != nil {
+		return err
+	}
+
+	for _, m := range modules {
+		key := cacheKey(m)
+		if c.touch(key) {
+			continue
+		}
+
+		tmp, err := os.MkdirTemp(c.dir, ".tmp-")
+		if err != nil {
+			return err
+		}
+
+		for _, d := range cacheVendorDirs {
+			src := filepath.Join(moduleRootPath, "cue.mod", d, m.Module)
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				continue
+			}
+			if err := copyCueFiles(src, filepath.Join(tmp, d, m.Module)); err != nil {
+				os.RemoveAll(tmp)
+				return fmt.Errorf("failed to cache module '%s@%s': %w", m.Module, m.Version, err)
+			}
+		}
+
+		hash, err := hashEntry(tmp)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(tmp, entryHashFile), []byte(hash), 0o600); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+
+		size, err := dirSize(tmp)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+
+		if err := c.add(key, tmp, size); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+// add moves the directory of a new entry into the cache and evicts the
+// least recently used entries if the cache is full.
+func (c *Cache) add(key, tmp string, size int64) error {
+	c.files.Lock()
+	defer c.files.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another reconcile cached the module in the meantime.
+	if _, ok := c.entries[key]; ok {
+		return os.RemoveAll(tmp)
+	}
+
+	if err := os.Rename(tmp, filepath.Join(c.dir, key)); err != nil {
+		return err
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// remove removes an entry from the cache.
+func (c *Cache) remove(key string) {
+	c.files.Lock()
+	defer c.files.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(c.dir, key)); err != nil {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.entries, key)
+	c.size -= e.Value.(*cacheEntry).size
+}
+
+// touch marks an entry as the most recently used one, and reports whether
+// it exists.
+func (c *Cache) touch(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	c.lru.MoveToFront(e)
+
+	// The modification time orders the entries when the controller restarts.
+	now := time.Now()
+	_ = os.Chtimes(filepath.Join(c.dir, key), now, now)
+	return true
+}
+
+// evict removes the least recently used entries until the cache fits its
+// size, it must be called with both locks held.
+func (c *Cache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		e := c.lru.Back()
+		entry := e.Value.(*cacheEntry)
+		if err := os.RemoveAll(filepath.Join(c.dir, entry.key)); err != nil {
+			return
+		}
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+	}
+}
+
+// checkSums returns an error if a module has no checksum.
+func checkSums(modules []Module) error {
+	for _, m := range modules {
+		if m.Sum == "" {
+			return fmt.Errorf("module '%s@%s' has no checksum and cannot be cached", m.Module, m.Version)
+		}
+	}
+	return nil
+}
+
+func cacheKey(m Module) string {
+	return url.PathEscape(m.Module) + "@" + url.PathEscape(m.Version) + "@" + url.PathEscape(m.Sum)
+}
+
+// hashEntry returns the hash of the files of a cache entry, in the format
+// of the checksums of Go modules.
+func hashEntry(dir string) (string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel != entryHashFile {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return dirhash.Hash1(files, func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	})
+}
+
+// verifyEntry reports whether the files of a cache entry match its hash.
+func verifyEntry(dir string) (bool, error) {
+	want, err := os.ReadFile(filepath.Join(dir, entryHashFile))
+	if err != nil {
+		return false, err
+	}
+	got, err := hashEntry(dir)
+	if err != nil {
+		return false, err
+	}
+	return got == string(want), nil
+}
+
+// copyCueFiles copies the CUE files in src into dst, following symbolic
+// links as cuemod links modules from the Go module cache.
+func copyCueFiles(src, dst string) error {
+	root, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			return copyCueFiles(path, target)
+		}
+		if d.IsDir() || filepath.Ext(path) != ".cue" {
+			return nil
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+			return err
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,269 @@
+package cuem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+func testModule(name string) Module {
+	return Module{
+		ModuleVersion: cueinstancev1a1.ModuleVersion{
+			Module:  "example.com/" + name,
+			Version: "v1.0.0",
+		},
+		Sum: "h1:" + name,
+	}
+}
+
+// vendorModule writes a CUE file of the given size for the module in the
+// cue.mod directory of a new module, and returns its root path.
+func vendorModule(t *testing.T, m Module, size int) string {
+	t.Helper()
+	root := t.TempDir()
+	dir := filepath.Join(root, "cue.mod", "pkg", m.Module)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	content := fmt.Sprintf("package %s\n", filepath.Base(m.Module))
+	content += "// " + strings.Repeat("x", size-len(content)-4) + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "lib.cue"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func entrySize(t *testing.T, c *Cache, m Module) int64 {
+	t.Helper()
+	size, err := dirSize(filepath.Join(c.dir, cacheKey(m)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return size
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	g := NewWithT(t)
+
+	a, b, d := testModule("a"), testModule("b"), testModule("d")
+
+	// The cache holds two entries of the same size.
+	probe, err := NewCache(t.TempDir(), 1<<20)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(probe.Store([]Module{a}, vendorModule(t, a, 512))).To(Succeed())
+	size := entrySize(t, probe, a)
+
+	c, err := NewCache(t.TempDir(), 2*size)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(c.Store([]Module{a}, vendorModule(t, a, 512))).To(Succeed())
+	g.Expect(c.Store([]Module{b}, vendorModule(t, b, 512))).To(Succeed())
+	g.Expect(c.size).To(Equal(2 * size))
+
+	// Using 'a' makes 'b' the least recently used entry.
+	found, err := c.Restore([]Module{a}, t.TempDir())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(BeTrue())
+
+	g.Expect(c.Store([]Module{d}, vendorModule(t, d, 512))).To(Succeed())
+	g.Expect(c.size).To(Equal(2 * size))
+	g.Expect(c.entries).To(HaveLen(2))
+	g.Expect(c.entries).To(HaveKey(cacheKey(a)))
+	g.Expect(c.entries).To(HaveKey(cacheKey(d)))
+
+	g.Expect(filepath.Join(c.dir, cacheKey(b))).NotTo(BeADirectory())
+	found, err = c.Restore([]Module{b}, t.TempDir())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+
+	// An entry larger than the cache is not kept.
+	large := testModule("large")
+	g.Expect(c.Store([]Module{large}, vendorModule(t, large, int(3*size)))).To(Succeed())
+	g.Expect(c.entries).To(BeEmpty())
+	g.Expect(c.size).To(BeZero())
+}
+
+func TestCache_RestoresMatchingSumAndIntactFiles(t *testing.T) {
+	g := NewWithT(t)
+
+	c, err := NewCache(t.TempDir(), 1<<20)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	a := testModule("a")
+	g.Expect(c.Store([]Module{a}, vendorModule(t, a, 128))).To(Succeed())
+
+	root := t.TempDir()
+	found, err := c.Restore([]Module{a}, root)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(BeTrue())
+	g.Expect(filepath.Join(root, "cue.mod", "pkg", a.Module, "lib.cue")).To(BeARegularFile())
+
+	// The entry is not restored for another checksum.
+	other := a
+	other.Sum = "h1:other"
+	found, err = c.Restore([]Module{other}, t.TempDir())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+
+	// A tampered entry is removed from the cache.
+	file := filepath.Join(c.dir, cacheKey(a), "pkg", a.Module, "lib.cue")
+	g.Expect(os.WriteFile(file, []byte("package a\n"), 0o600)).To(Succeed())
+
+	found, err = c.Restore([]Module{a}, t.TempDir())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+	g.Expect(c.entries).To(BeEmpty())
+	g.Expect(c.size).To(BeZero())
+	g.Expect(filepath.Join(c.dir, cacheKey(a))).NotTo(BeADirectory())
+}
+
+func TestCache_RefusesModulesWithoutSum(t *testing.T) {
+	g := NewWithT(t)
+
+	c, err := NewCache(t.TempDir(), 1<<20)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	a, b := testModule("a"), testModule("b")
+	b.Sum = ""
+
+	g.Expect(c.Store([]Module{a, b}, vendorModule(t, a, 128))).NotTo(Succeed())
+	g.Expect(c.entries).To(BeEmpty())
+
+	g.Expect(c.Store([]Module{a}, vendorModule(t, a, 128))).To(Succeed())
+	found, err := c.Restore([]Module{a, b}, t.TempDir())
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+}
+
+func TestNewCache_ReindexesEntries(t *testing.T) {
+	g := NewWithT(t)
+	dir := t.TempDir()
+
+	a, b := testModule("a"), testModule("b")
+
+	c, err := NewCache(dir, 1<<20)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c.Store([]Module{a}, vendorModule(t, a, 512))).To(Succeed())
+	g.Expect(c.Store([]Module{b}, vendorModule(t, b, 512))).To(Succeed())
+	size := entrySize(t, c, a)
+
+	// 'a' was used last before the controller stopped.
+	now := time.Now()
+	g.Expect(os.Chtimes(filepath.Join(dir, cacheKey(a)), now, now)).To(Succeed())
+	earlier := now.Add(-time.Hour)
+	g.Expect(os.Chtimes(filepath.Join(dir, cacheKey(b)), earlier, earlier)).To(Succeed())
+
+	// Entries being written when the controller stopped are removed.
+	tmp := filepath.Join(dir, ".tmp-123")
+	g.Expect(os.MkdirAll(filepath.Join(tmp, "pkg"), 0o700)).To(Succeed())
+	stray := filepath.Join(dir, "stray")
+	g.Expect(os.WriteFile(stray, []byte("stray"), 0o600)).To(Succeed())
+
+	c, err = NewCache(dir, 1<<20)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c.entries).To(HaveLen(2))
+	g.Expect(c.size).To(Equal(2 * size))
+	g.Expect(tmp).NotTo(BeADirectory())
+	g.Expect(stray).NotTo(BeAnExistingFile())
+
+	found, err := c.Restore([]Module{a, b}, t.TempDir())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(BeTrue())
+
+	// Reopened with room for a single entry, the least recently used one
+	// is evicted.
+	g.Expect(os.Chtimes(filepath.Join(dir, cacheKey(a)), now, now)).To(Succeed())
+	g.Expect(os.Chtimes(filepath.Join(dir, cacheKey(b)), earlier, earlier)).To(Succeed())
+
+	c, err = NewCache(dir, size)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c.entries).To(HaveLen(1))
+	g.Expect(c.entries).To(HaveKey(cacheKey(a)))
+	g.Expect(c.size).To(Equal(size))
+	g.Expect(filepath.Join(dir, cacheKey(b))).NotTo(BeADirectory())
+}
+
+func TestCache_ConcurrentStoreAndRestore(t *testing.T) {
+	g := NewWithT(t)
+
+	modules := make([]Module, 8)
+	roots := make([]string, len(modules))
+	for i := range modules {
+		modules[i] = testModule(fmt.Sprintf("m%d", i))
+		roots[i] = vendorModule(t, modules[i], 256)
+	}
+
+	// The cache holds half of the modules, so that entries are evicted
+	// while others are restored.
+	probe, err := NewCache(t.TempDir(), 1<<20)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(probe.Store(modules[:1], roots[0])).To(Succeed())
+	size := entrySize(t, probe, modules[0])
+
+	c, err := NewCache(t.TempDir(), int64(len(modules)/2)*size)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16*len(modules))
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := range modules {
+				m := modules[(i+w)%len(modules)]
+				if err := c.Store([]Module{m}, roots[(i+w)%len(modules)]); err != nil {
+					errs <- err
+					return
+				}
+
+				root := t.TempDir()
+				found, err := c.Restore([]Module{m}, root)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !found {
+					continue
+				}
+				data, err := os.ReadFile(filepath.Join(root, "cue.mod", "pkg", m.Module, "lib.cue"))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !strings.HasPrefix(string(data), "package "+filepath.Base(m.Module)+"\n") {
+					errs <- fmt.Errorf("restored unexpected content for '%s': %q", m.Module, data)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	g.Expect(c.size).To(BeNumerically("<=", int64(len(modules)/2)*size))
+	g.Expect(c.entries).To(HaveLen(c.lru.Len()))
+
+	var onDisk int64
+	for key := range c.entries {
+		size, err := dirSize(filepath.Join(c.dir, key))
+		g.Expect(err).NotTo(HaveOccurred())
+		onDisk += size
+	}
+	g.Expect(c.size).To(Equal(onDisk))
+
+	items, err := os.ReadDir(c.dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(items).To(HaveLen(len(c.entries)))
+}
@@ -2,18 +2,290 @@ package cuem
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/cue/literal"
+	"cuelang.org/go/cue/parser"
 	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
 	_ "github.com/akirill0v/cue-flux-controller/internal/cue"
 	"github.com/octohelm/cuemod/pkg/cuemod"
+	ctrl "sigs.k8s.io/controller-runtime"
 )
 
-type CueDependencyManager struct{}
+// vendorDirs are the directories of the cue.mod directory in which CUE
+// looks up imported packages.
+var vendorDirs = []string{"pkg", "gen", "usr"}
+
+type CueDependencyManager struct {
+	// NoRemoteBases forbids fetching remote modules, the imported packages
+	// must be vendored in the cue.mod directory of the module.
+	NoRemoteBases bool
+
+	// Cache holds the modules pinned in 'Locked' mode by previous
+	// reconciles. It is neither consulted nor filled in 'Upgrade' mode, in
+	// which cuemod resolves the latest versions of the modules.
+	Cache *Cache
+}
+
+func (m CueDependencyManager) Get(ctx context.Context, moduleRootPath, dirPath string, mode cueinstancev1a1.DependencyMode, obj *cueinstancev1a1.CueInstance) ([]cueinstancev1a1.ModuleVersion, error) {
+	if m.NoRemoteBases {
+		if err := checkVendored(moduleRootPath, dirPath); err != nil {
+			return nil, fmt.Errorf("remote bases are disabled: %w", err)
+		}
+		return readModuleVersions(moduleRootPath)
+	}
+
+	if mode == cueinstancev1a1.VendoredDependencyMode {
+		if err := checkVendored(moduleRootPath, dirPath); err != nil {
+			return nil, err
+		}
+		return readModuleVersions(moduleRootPath)
+	}
+
+	locked, err := readModuleSum(moduleRootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cached modules are only restored for the checksums pinned in
+	// cue.mod/module.sum, and if their files are intact.
+	if mode == cueinstancev1a1.LockedDependencyMode && m.Cache != nil && len(locked) > 0 && checkSums(locked) == nil {
+		found, err := m.Cache.Restore(locked, moduleRootPath)
+		if err != nil {
+			return nil, err
+		}
+		// Imports of modules which are not pinned are left to cuemod.
+		if found && checkVendored(moduleRootPath, dirPath) == nil {
+			return moduleVersions(locked), nil
+		}
+	}
 
-func (m CueDependencyManager) Get(ctx context.Context, moduleRootPath, dirPath string, upgrade bool, obj *cueinstancev1a1.CueInstance) error {
 	cc := cuemod.ContextFor(moduleRootPath)
-	return cc.Get(cuemod.WithOpts(ctx,
-		cuemod.OptUpgrade(upgrade),
+	if err := cc.Get(cuemod.WithOpts(ctx,
+		cuemod.OptUpgrade(mode == cueinstancev1a1.UpgradeDependencyMode),
 		cuemod.OptImport("go"),
-		cuemod.OptVerbose(true)), dirPath)
+		cuemod.OptVerbose(true)), dirPath); err != nil {
+		return nil, err
+	}
+
+	resolved, err := readModuleSum(moduleRootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == cueinstancev1a1.LockedDependencyMode {
+		if err := checkPinned(locked, resolved); err != nil {
+			return nil, err
+		}
+		if m.Cache != nil && checkSums(resolved) == nil {
+			if err := m.Cache.Store(resolved, moduleRootPath); err != nil {
+				ctrl.LoggerFrom(ctx).Error(err, "failed to cache the CUE module dependencies")
+			}
+		}
+	}
+
+	return moduleVersions(resolved), nil
+}
+
+// checkPinned returns an error if a resolved module is not pinned, or is
+// pinned to another version or checksum.
+func checkPinned(locked, resolved []Module) error {
+	pinned := make(map[string]Module, len(locked))
+	for _, mv := range locked {
+		pinned[mv.Module] = mv
+	}
+	for _, mv := range resolved {
+		p, ok := pinned[mv.Module]
+		if !ok {
+			return fmt.Errorf("module '%s' resolved to '%s' is not pinned in %s",
+				mv.Module, mv.Version, cuemod.ModSumFilename)
+		}
+		if p.Version != mv.Version {
+			return fmt.Errorf("module '%s' resolved to '%s' but is pinned to '%s' in %s",
+				mv.Module, mv.Version, p.Version, cuemod.ModSumFilename)
+		}
+		if p.Sum != "" && mv.Sum != "" && p.Sum != mv.Sum {
+			return fmt.Errorf("module '%s@%s' has checksum '%s' but '%s' is pinned in %s",
+				mv.Module, mv.Version, mv.Sum, p.Sum, cuemod.ModSumFilename)
+		}
+	}
+	return nil
+}
+
+// readModuleSum returns the modules listed in cue.mod/module.sum, which
+// cuemod writes as one '<module> <version> <sum>' line per module.
+func readModuleSum(moduleRootPath string) ([]Module, error) {
+	data, err := os.ReadFile(filepath.Join(moduleRootPath, cuemod.ModSumFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var modules []Module
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid %s line: '%s'", cuemod.ModSumFilename, line)
+		}
+		m := Module{ModuleVersion: cueinstancev1a1.ModuleVersion{
+			Module:  fields[0],
+			Version: fields[1],
+		}}
+		if len(fields) > 2 {
+			m.Sum = fields[2]
+		}
+		modules = append(modules, m)
+	}
+	return modules, nil
+}
+
+// readModuleVersions returns the module versions listed in
+// cue.mod/module.sum.
+func readModuleVersions(moduleRootPath string) ([]cueinstancev1a1.ModuleVersion, error) {
+	modules, err := readModuleSum(moduleRootPath)
+	if err != nil {
+		return nil, err
+	}
+	return moduleVersions(modules), nil
+}
+
+func moduleVersions(modules []Module) []cueinstancev1a1.ModuleVersion {
+	if modules == nil {
+		return nil
+	}
+	versions := make([]cueinstancev1a1.ModuleVersion, 0, len(modules))
+	for _, m := range modules {
+		versions = append(versions, m.ModuleVersion)
+	}
+	return versions
+}
+
+// checkVendored returns an error if the CUE files in dirPath, or the
+// packages they import, import a package which is neither part of the
+// module nor vendored in its cue.mod directory.
+func checkVendored(moduleRootPath, dirPath string) error {
+	module, err := moduleName(moduleRootPath)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	dirs := []string{filepath.Join(moduleRootPath, dirPath)}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		imports, err := importPaths(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range imports {
+			if seen[p] || isBuiltin(p) {
+				continue
+			}
+			seen[p] = true
+
+			found := ""
+			candidates := make([]string, 0, len(vendorDirs)+1)
+			if base, local := stripMajor(module), stripMajor(p); module != "" &&
+				(local == base || strings.HasPrefix(local, base+"/")) {
+				candidates = append(candidates, filepath.Join(moduleRootPath, strings.TrimPrefix(local, base)))
+			}
+			for _, d := range vendorDirs {
+				candidates = append(candidates, filepath.Join(moduleRootPath, "cue.mod", d, p))
+			}
+			for _, c := range candidates {
+				if info, err := os.Stat(c); err == nil && info.IsDir() {
+					found = c
+					break
+				}
+			}
+			if found == "" {
+				return fmt.Errorf("package '%s' is not vendored in the cue.mod directory", p)
+			}
+			dirs = append(dirs, found)
+		}
+	}
+	return nil
+}
+
+// moduleName returns the name declared in cue.mod/module.cue, or an empty
+// string if there is none.
+func moduleName(moduleRootPath string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(moduleRootPath, "cue.mod", "module.cue"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	v := cuecontext.New().CompileBytes(data)
+	if v.Err() != nil {
+		return "", fmt.Errorf("invalid cue.mod/module.cue: %w", v.Err())
+	}
+	name, _ := v.LookupPath(cue.ParsePath("module")).String()
+	return name, nil
+}
+
+// importPaths returns the paths imported by the CUE files in dir, without
+// their package qualifier.
+func importPaths(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".cue" {
+			continue
+		}
+		f, err := parser.ParseFile(filepath.Join(dir, e.Name()), nil, parser.ImportsOnly)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range f.Imports {
+			p, err := literal.Unquote(i.Path.Value)
+			if err != nil {
+				return nil, err
+			}
+			if idx := strings.LastIndex(p, ":"); idx >= 0 {
+				p = p[:idx]
+			}
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// stripMajor removes the major version from a path of a native CUE module,
+// e.g. 'example.com/foo@v0/bar' becomes 'example.com/foo/bar'.
+func stripMajor(p string) string {
+	i := strings.Index(p, "@")
+	if i < 0 {
+		return p
+	}
+	rest := ""
+	if j := strings.Index(p[i:], "/"); j >= 0 {
+		rest = p[i+j:]
+	}
+	return p[:i] + rest
+}
+
+// isBuiltin reports whether the import path is a package of the CUE
+// standard library, whose first element has no dot.
+func isBuiltin(p string) bool {
+	return !strings.Contains(strings.SplitN(p, "/", 2)[0], ".")
 }
@@ -0,0 +1,417 @@
+package cuem
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+const (
+	// DefaultRegistry is the registry of the native CUE modules when none
+	// is configured.
+	DefaultRegistry = "registry.cue.works"
+
+	// moduleZipMediaType is the media type of the layer holding the files
+	// of a native CUE module.
+	moduleZipMediaType = "application/zip"
+
+	// maxModuleSize limits the size of the extracted files of a module.
+	maxModuleSize = 100 << 20
+)
+
+// NativeDependencyManager fetches the dependencies of native CUE modules,
+// declared in the 'deps' of cue.mod/module.cue, from OCI registries. Each
+// module is vendored in cue.mod/pkg, where CUE finds its packages with or
+// without the major version of the module in the import path.
+type NativeDependencyManager struct {
+	// NoRemoteBases forbids fetching remote modules, the imported packages
+	// must be vendored in the cue.mod directory of the module.
+	NoRemoteBases bool
+
+	// Registry configures the registries in the format of CUE_REGISTRY,
+	// defaults to DefaultRegistry.
+	Registry string
+
+	// Keychain provides the credentials of the registries, defaults to
+	// anonymous access.
+	Keychain authn.Keychain
+
+	// Cache holds the modules fetched by previous reconciles.
+	Cache *Cache
+}
+
+func (m NativeDependencyManager) Get(ctx context.Context, moduleRootPath, dirPath string, mode cueinstancev1a1.DependencyMode, obj *cueinstancev1a1.CueInstance) ([]cueinstancev1a1.ModuleVersion, error) {
+	deps, err := readNativeDeps(moduleRootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.NoRemoteBases {
+		if err := checkVendored(moduleRootPath, dirPath); err != nil {
+			return nil, fmt.Errorf("remote bases are disabled: %w", err)
+		}
+		return deps, nil
+	}
+
+	if mode == cueinstancev1a1.VendoredDependencyMode {
+		if err := checkVendored(moduleRootPath, dirPath); err != nil {
+			return nil, err
+		}
+		return deps, nil
+	}
+
+	registries, err := parseRegistries(m.Registry)
+	if err != nil {
+		return nil, err
+	}
+
+	keychain := m.Keychain
+	if keychain == nil {
+		keychain = registryKeychain{}
+	}
+
+	for _, dep := range deps {
+		basePath, major, _ := strings.Cut(dep.Module, "@")
+
+		// The manifest is always resolved with the credentials of the
+		// CueInstance, the cache only saves downloading the module.
+		ref, img, err := resolveNativeModule(ctx, registries.resolve(basePath), keychain, basePath, dep.Version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch module '%s@%s': %w", basePath, dep.Version, err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch module '%s@%s': %w", basePath, dep.Version, err)
+		}
+		cached := []Module{{
+			ModuleVersion: cueinstancev1a1.ModuleVersion{Module: basePath, Version: dep.Version},
+			Sum:           fmt.Sprintf("%s@%s", ref.Context().Name(), digest),
+		}}
+
+		found := false
+		if m.Cache != nil {
+			if found, err = m.Cache.Restore(cached, moduleRootPath); err != nil {
+				return nil, err
+			}
+		}
+
+		if !found {
+			if err := extractNativeModule(ref, img, filepath.Join(moduleRootPath, "cue.mod", "pkg", basePath)); err != nil {
+				return nil, fmt.Errorf("failed to fetch module '%s@%s': %w", basePath, dep.Version, err)
+			}
+			if m.Cache != nil {
+				if err := m.Cache.Store(cached, moduleRootPath); err != nil {
+					ctrl.LoggerFrom(ctx).Error(err, "failed to cache the CUE module dependencies")
+				}
+			}
+		}
+
+		// Imports may name the major version of the module.
+		if major != "" {
+			link := filepath.Join(moduleRootPath, "cue.mod", "pkg", dep.Module)
+			if err := os.RemoveAll(link); err != nil {
+				return nil, err
+			}
+			if err := os.Symlink(path.Base(basePath), link); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := checkVendored(moduleRootPath, dirPath); err != nil {
+		return nil, fmt.Errorf("%w, it is missing from the deps of cue.mod/module.cue", err)
+	}
+	return deps, nil
+}
+
+// readNativeDeps returns the dependencies declared in cue.mod/module.cue,
+// by module path with its major version.
+func readNativeDeps(moduleRootPath string) ([]cueinstancev1a1.ModuleVersion, error) {
+	data, err := os.ReadFile(filepath.Join(moduleRootPath, "cue.mod", "module.cue"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v := cuecontext.New().CompileBytes(data)
+	if v.Err() != nil {
+		return nil, fmt.Errorf("invalid cue.mod/module.cue: %w", v.Err())
+	}
+
+	var declared map[string]struct {
+		V string `json:"v"`
+	}
+	if d := v.LookupPath(cue.ParsePath("deps")); d.Exists() {
+		if err := d.Decode(&declared); err != nil {
+			return nil, fmt.Errorf("invalid deps in cue.mod/module.cue: %w", err)
+		}
+	}
+
+	deps := make([]cueinstancev1a1.ModuleVersion, 0, len(declared))
+	for module, dep := range declared {
+		if !strings.Contains(module, "@") || dep.V == "" {
+			return nil, fmt.Errorf("invalid dependency '%s' in cue.mod/module.cue, a major version and a version are required", module)
+		}
+		deps = append(deps, cueinstancev1a1.ModuleVersion{Module: module, Version: dep.V})
+	}
+	// Modules are vendored in the directory of their base path, which may
+	// be nested in the one of another module.
+	sort.Slice(deps, func(i, j int) bool {
+		return stripMajor(deps[i].Module) < stripMajor(deps[j].Module)
+	})
+	return deps, nil
+}
+
+// resolveNativeModule returns the reference and the image of a module
+// published in the given registry, whose manifest is fetched.
+func resolveNativeModule(ctx context.Context, reg registry, keychain authn.Keychain, basePath, version string) (name.Reference, v1.Image, error) {
+	var opts []name.Option
+	if reg.insecure {
+		opts = append(opts, name.Insecure)
+	}
+	ref, err := name.ParseReference(fmt.Sprintf("%s:%s", reg.repository(basePath), version), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	img, err := remote.Image(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(keychain))
+	if err != nil {
+		return nil, nil, err
+	}
+	return ref, img, nil
+}
+
+// extractNativeModule extracts the files of the image of a module into dir.
+func extractNativeModule(ref name.Reference, img v1.Image, dir string) error {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+
+	var layer v1.Layer
+	for _, l := range manifest.Layers {
+		if l.MediaType == moduleZipMediaType {
+			if layer, err = img.LayerByDigest(l.Digest); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if layer == nil {
+		return fmt.Errorf("'%s' is not a CUE module, no '%s' layer found", ref, moduleZipMediaType)
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, maxModuleSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxModuleSize {
+		return fmt.Errorf("module exceeds %d bytes", maxModuleSize)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return extractZip(data, dir)
+}
+
+func extractZip(data []byte, dir string) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	var size uint64
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		size += f.UncompressedSize64
+		if size > maxModuleSize {
+			return fmt.Errorf("module exceeds %d bytes", maxModuleSize)
+		}
+
+		target, err := securejoin.SecureJoin(dir, f.Name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+			return err
+		}
+
+		if err := extractZipFile(f, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractZipFile(f *zip.File, target string) error {
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.LimitReader(in, int64(f.UncompressedSize64))); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// registry is an OCI registry of native CUE modules, with the repository
+// prefix under which the modules are published.
+type registry struct {
+	host     string
+	prefix   string
+	insecure bool
+}
+
+func (r registry) repository(basePath string) string {
+	return path.Join(r.host, r.prefix, basePath)
+}
+
+// registries maps module path prefixes to registries, the empty prefix
+// maps to the default registry.
+type registries map[string]registry
+
+// parseRegistries parses a registry configuration in the format of
+// CUE_REGISTRY, a comma-separated list of 'registry' or
+// 'modulePrefix=registry' entries, where registry is
+// 'host[:port][/repoPrefix][+insecure]'.
+func parseRegistries(config string) (registries, error) {
+	regs := registries{}
+	if strings.TrimSpace(config) == "" {
+		config = DefaultRegistry
+	}
+
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix, location, ok := strings.Cut(entry, "=")
+		if !ok {
+			prefix, location = "", entry
+		}
+		if _, exists := regs[prefix]; exists {
+			return nil, fmt.Errorf("invalid registry configuration: duplicate entry for '%s'", prefix)
+		}
+
+		reg := registry{}
+		location, reg.insecure = strings.CutSuffix(location, "+insecure")
+		reg.host, reg.prefix, _ = strings.Cut(location, "/")
+		if reg.host == "" {
+			return nil, fmt.Errorf("invalid registry configuration: no host in '%s'", entry)
+		}
+		if _, err := name.NewRegistry(reg.host); err != nil {
+			return nil, fmt.Errorf("invalid registry configuration: %w", err)
+		}
+		regs[prefix] = reg
+	}
+
+	if _, ok := regs[""]; !ok {
+		regs[""] = registry{host: DefaultRegistry}
+	}
+	return regs, nil
+}
+
+// resolve returns the registry of the module, the one of the longest
+// matching prefix.
+func (r registries) resolve(basePath string) registry {
+	best := ""
+	for prefix := range r {
+		if len(prefix) > len(best) && (basePath == prefix || strings.HasPrefix(basePath, prefix+"/")) {
+			best = prefix
+		}
+	}
+	return r[best]
+}
+
+// NewRegistryKeychain returns the credentials held by the data of a Secret,
+// either a '.dockerconfigjson' key with the credentials of each registry,
+// or 'username' and 'password' keys used for all registries.
+func NewRegistryKeychain(data map[string][]byte) (authn.Keychain, error) {
+	if config, ok := data[".dockerconfigjson"]; ok {
+		var dockerConfig struct {
+			Auths map[string]authn.AuthConfig `json:"auths"`
+		}
+		if err := json.Unmarshal(config, &dockerConfig); err != nil {
+			return nil, fmt.Errorf("invalid .dockerconfigjson: %w", err)
+		}
+
+		k := registryKeychain{auths: map[string]authn.AuthConfig{}}
+		for host, auth := range dockerConfig.Auths {
+			host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+			host, _, _ = strings.Cut(host, "/")
+			if auth.Auth != "" && auth.Username == "" {
+				decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+				if err != nil {
+					return nil, fmt.Errorf("invalid auth for '%s' in .dockerconfigjson: %w", host, err)
+				}
+				auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+				auth.Auth = ""
+			}
+			k.auths[host] = auth
+		}
+		return k, nil
+	}
+
+	username, password := data["username"], data["password"]
+	if len(username) == 0 || len(password) == 0 {
+		return nil, fmt.Errorf("'.dockerconfigjson' or 'username' and 'password' keys are required")
+	}
+	return registryKeychain{
+		fallback: &authn.AuthConfig{Username: string(username), Password: string(password)},
+	}, nil
+}
+
+type registryKeychain struct {
+	auths    map[string]authn.AuthConfig
+	fallback *authn.AuthConfig
+}
+
+// Resolve implements authn.Keychain.
+func (k registryKeychain) Resolve(r authn.Resource) (authn.Authenticator, error) {
+	if auth, ok := k.auths[r.RegistryStr()]; ok {
+		return authn.FromConfig(auth), nil
+	}
+	if k.fallback != nil {
+		return authn.FromConfig(*k.fallback), nil
+	}
+	return authn.Anonymous, nil
+}
@@ -0,0 +1,168 @@
+package cuem
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	ociregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	. "github.com/onsi/gomega"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// testRegistry starts an in-process OCI registry, requiring basic auth if
+// auth is set, and returns its host.
+func testRegistry(t *testing.T, auth *authn.Basic) string {
+	t.Helper()
+	handler := ociregistry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth != nil {
+			if u, p, ok := r.BasicAuth(); !ok || u != auth.Username || p != auth.Password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+// publishModule publishes example.com/lib@v0.1.0 with the given lib.cue in
+// the registry.
+func publishModule(t *testing.T, host string, auth authn.Authenticator, content string) {
+	t.Helper()
+	var data bytes.Buffer
+	zw := zip.NewWriter(&data)
+	f, err := zw.Create("lib.cue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := mutate.AppendLayers(
+		mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1),
+			"application/vnd.cue.module.v1+json"),
+		static.NewLayer(data.Bytes(), moduleZipMediaType),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := name.ParseReference(host+"/modules/example.com/lib:v0.1.0", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, remote.WithAuth(auth)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// appModule writes a module importing example.com/lib and returns its root.
+func appModule(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		"cue.mod/module.cue": `module: "example.com/app@v0"
+language: version: "v0.9.0"
+deps: "example.com/lib@v0": v: "v0.1.0"
+`,
+		"main.cue": `package main
+
+import "example.com/lib@v0:lib"
+
+out: lib.name
+`,
+	}
+	for file, content := range files {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestNativeDependencyManager_CacheIsKeyedByRegistryAndDigest(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	auth := &authn.Basic{Username: "cue", Password: "secret"}
+	private := testRegistry(t, auth)
+	publishModule(t, private, auth, "package lib\n\nname: \"private\"\n")
+
+	public := testRegistry(t, nil)
+	publishModule(t, public, authn.Anonymous, "package lib\n\nname: \"public\"\n")
+
+	cache, err := NewCache(t.TempDir(), 1<<20)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	keychain, err := NewRegistryKeychain(map[string][]byte{
+		"username": []byte(auth.Username),
+		"password": []byte(auth.Password),
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	libFile := func(root string) string {
+		data, err := os.ReadFile(filepath.Join(root, "cue.mod", "pkg", "example.com", "lib", "lib.cue"))
+		g.Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	// The module is fetched with the credentials and cached.
+	root := appModule(t)
+	m := NativeDependencyManager{Registry: private + "/modules+insecure", Keychain: keychain, Cache: cache}
+	_, err = m.Get(ctx, root, ".", cueinstancev1a1.UpgradeDependencyMode, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(libFile(root)).To(ContainSubstring(`"private"`))
+	g.Expect(cache.entries).To(HaveLen(1))
+
+	// The cached module is not restored without the credentials.
+	m = NativeDependencyManager{Registry: private + "/modules+insecure", Cache: cache}
+	_, err = m.Get(ctx, appModule(t), ".", cueinstancev1a1.UpgradeDependencyMode, nil)
+	g.Expect(err).To(HaveOccurred())
+
+	// Nor for the same version of the module in another registry.
+	root = appModule(t)
+	m = NativeDependencyManager{Registry: public + "/modules+insecure", Cache: cache}
+	_, err = m.Get(ctx, root, ".", cueinstancev1a1.UpgradeDependencyMode, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(libFile(root)).To(ContainSubstring(`"public"`))
+	g.Expect(cache.entries).To(HaveLen(2))
+
+	// The cached module is used again with the credentials.
+	root = appModule(t)
+	m = NativeDependencyManager{Registry: private + "/modules+insecure", Keychain: keychain, Cache: cache}
+	_, err = m.Get(ctx, root, ".", cueinstancev1a1.UpgradeDependencyMode, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(libFile(root)).To(ContainSubstring(`"private"`))
+	g.Expect(cache.entries).To(HaveLen(2))
+}
@@ -1,33 +1,43 @@
 package cue
 
 import (
+	"bytes"
+
 	"cuelang.org/go/cue"
 	"cuelang.org/go/encoding/yaml"
 )
 
-func CueEncodeYAML(value cue.Value) ([]byte, error) {
-	var (
-		err  error
-		data []byte
-	)
+// CueObjects returns the items of a list, or a struct, as the Kubernetes
+// objects of value. Any other value has no objects.
+func CueObjects(value cue.Value) ([]cue.Value, error) {
 	switch value.Kind() {
 	case cue.ListKind:
 		items, err := value.List()
 		if err != nil {
 			return nil, err
 		}
-		data, err = yaml.EncodeStream(items)
-		if err != nil {
-			return nil, err
+		var objects []cue.Value
+		for items.Next() {
+			objects = append(objects, items.Value())
 		}
+		return objects, nil
 	case cue.StructKind:
-		data, err = yaml.Encode(value)
+		return []cue.Value{value}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// CueEncodeStream encodes the given objects as a stream of YAML documents.
+func CueEncodeStream(objects []cue.Value) ([]byte, error) {
+	var result bytes.Buffer
+	for _, o := range objects {
+		data, err := yaml.Encode(o)
 		if err != nil {
 			return nil, err
 		}
-	default:
-		return nil, nil
+		result.Write(data)
+		result.WriteString("\n---\n")
 	}
-	data = append(data, []byte("\n---\n")...)
-	return data, nil
+	return result.Bytes(), nil
 }
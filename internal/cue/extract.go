@@ -0,0 +1,88 @@
+package cue
+
+import (
+	"fmt"
+
+	"cuelang.org/go/cue"
+)
+
+// SkippedValue is a value which was not emitted by CueExtractObjects.
+type SkippedValue struct {
+	Path   string
+	Reason string
+}
+
+func (s SkippedValue) String() string {
+	return fmt.Sprintf("%s (%s)", s.Path, s.Reason)
+}
+
+// CueExtractObjects walks the nested structs and lists of value and returns
+// every value with an apiVersion and a kind field, in order. Other leaves,
+// and values nested deeper than maxDepth, are returned as skipped.
+func CueExtractObjects(value cue.Value, maxDepth int) ([]cue.Value, []SkippedValue, error) {
+	var (
+		objects []cue.Value
+		skipped []SkippedValue
+	)
+
+	var walk func(v cue.Value, depth int) error
+	walk = func(v cue.Value, depth int) error {
+		if v.Err() != nil {
+			return v.Err()
+		}
+
+		if isObject(v) {
+			objects = append(objects, v)
+			return nil
+		}
+
+		switch v.IncompleteKind() {
+		case cue.StructKind, cue.ListKind:
+		default:
+			skipped = append(skipped, SkippedValue{Path: v.Path().String(), Reason: "not an object"})
+			return nil
+		}
+
+		if depth >= maxDepth {
+			skipped = append(skipped, SkippedValue{Path: v.Path().String(), Reason: "max depth exceeded"})
+			return nil
+		}
+
+		if v.IncompleteKind() == cue.ListKind {
+			items, err := v.List()
+			if err != nil {
+				return err
+			}
+			for items.Next() {
+				if err := walk(items.Value(), depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		fields, err := v.Fields()
+		if err != nil {
+			return err
+		}
+		for fields.Next() {
+			if err := walk(fields.Value(), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(value, 0); err != nil {
+		return nil, nil, err
+	}
+	return objects, skipped, nil
+}
+
+func isObject(v cue.Value) bool {
+	if v.IncompleteKind() != cue.StructKind {
+		return false
+	}
+	return v.LookupPath(cue.ParsePath("apiVersion")).Exists() &&
+		v.LookupPath(cue.ParsePath("kind")).Exists()
+}
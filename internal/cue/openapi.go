@@ -0,0 +1,140 @@
+package cue
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/encoding/openapi"
+)
+
+// OpenAPISchemas holds the CUE representation of the OpenAPI v3 schemas
+// published by a Kubernetes API server for a group version.
+type OpenAPISchemas struct {
+	mu    sync.Mutex
+	file  *ast.File
+	kinds map[string]string
+}
+
+// CueOpenAPISchemas converts an OpenAPI v3 document of a Kubernetes API
+// server to CUE. Object schemas are closed, unless they preserve unknown
+// fields, so that the fields the API server would prune are reported, and
+// defaults are dropped as they would otherwise accept any value.
+func CueOpenAPISchemas(data []byte) (*OpenAPISchemas, error) {
+	var doc struct {
+		Components struct {
+			Schemas map[string]map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode OpenAPI document: %w", err)
+	}
+
+	kinds := map[string]string{}
+	for name, schema := range doc.Components.Schemas {
+		closeSchema(schema)
+
+		gvks, _ := schema["x-kubernetes-group-version-kind"].([]interface{})
+		for _, gvk := range gvks {
+			m, _ := gvk.(map[string]interface{})
+			group, _ := m["group"].(string)
+			version, _ := m["version"].(string)
+			kind, _ := m["kind"].(string)
+			kinds[openAPIKindKey(group, version, kind)] = name
+		}
+	}
+
+	// Only the schemas are converted, the remainder of the document
+	// describes the API paths.
+	data, err := json.Marshal(map[string]interface{}{
+		"openapi":    "3.0.0",
+		"info":       map[string]string{"title": "Kubernetes", "version": "unversioned"},
+		"components": doc.Components,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	v := cuecontext.New().CompileBytes(data)
+	if v.Err() != nil {
+		return nil, v.Err()
+	}
+
+	file, err := openapi.Extract(v, &openapi.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert OpenAPI schemas: %w", err)
+	}
+
+	return &OpenAPISchemas{
+		file:  file,
+		kinds: kinds,
+	}, nil
+}
+
+// Schema returns the schema of the given kind built in ctx, and false if
+// there is none.
+func (s *OpenAPISchemas) Schema(ctx *cue.Context, apiVersion, kind string) (cue.Value, bool, error) {
+	name, ok := s.kinds[apiVersion+"/"+kind]
+	if !ok {
+		return cue.Value{}, false, nil
+	}
+
+	// Building the file resolves its identifiers in place.
+	s.mu.Lock()
+	root := ctx.BuildFile(s.file)
+	s.mu.Unlock()
+	if root.Err() != nil {
+		return cue.Value{}, false, root.Err()
+	}
+
+	// Schema names which are not identifiers are mapped to fields of
+	// #SchemaMap by openapi.Extract.
+	path := cue.MakePath(cue.Def("SchemaMap"), cue.Str(name))
+	if ast.IsValidIdent(name) && name != "SchemaMap" && !strings.HasPrefix(name, "_") {
+		path = cue.MakePath(cue.Def(name))
+	}
+	schema := root.LookupPath(path)
+	return schema, schema.Exists(), nil
+}
+
+func openAPIKindKey(group, version, kind string) string {
+	if group == "" {
+		return version + "/" + kind
+	}
+	return group + "/" + version + "/" + kind
+}
+
+// closeSchema disallows unknown fields in the object schemas nested in
+// schema and removes their defaults.
+func closeSchema(v interface{}) {
+	schema, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	delete(schema, "default")
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		_, hasAdditional := schema["additionalProperties"]
+		preserve, _ := schema["x-kubernetes-preserve-unknown-fields"].(bool)
+		if !hasAdditional && !preserve {
+			schema["additionalProperties"] = false
+		}
+		for _, p := range properties {
+			closeSchema(p)
+		}
+	}
+
+	closeSchema(schema["items"])
+	closeSchema(schema["additionalProperties"])
+	closeSchema(schema["not"])
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		items, _ := schema[key].([]interface{})
+		for _, i := range items {
+			closeSchema(i)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package cue
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"cuelang.org/go/cue"
+)
+
+// SelectExpressions returns the values of root selected by the given
+// expressions, in order, without the values matched by any of the
+// excludes. Expressions which are not valid CUE paths or contain '*' or
+// '?' are glob selectors: each dot separated segment is matched with
+// path.Match against the field labels of a struct or the indices of a list.
+// An exclude also removes every value nested beneath the path it matches.
+func SelectExpressions(root cue.Value, exprs, excludes []string) ([]cue.Value, error) {
+	var selected []cue.Value
+	for _, e := range exprs {
+		var values []cue.Value
+		if isGlob(e) {
+			segments, err := splitSelector(e)
+			if err != nil {
+				return nil, err
+			}
+			values, err = expand(root, segments)
+			if err != nil {
+				return nil, fmt.Errorf("failed to expand expression '%s': %w", e, err)
+			}
+		} else {
+			values = []cue.Value{root.LookupPath(cue.ParsePath(e))}
+		}
+
+		values, err := FilterExcluded(values, excludes)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, values...)
+	}
+	return selected, nil
+}
+
+// FilterExcluded returns the given values without those matched by, or
+// nested beneath a path matched by, any of the excludes.
+func FilterExcluded(values []cue.Value, excludes []string) ([]cue.Value, error) {
+	if len(excludes) == 0 {
+		return values, nil
+	}
+
+	var filtered []cue.Value
+	for _, v := range values {
+		excluded, err := isExcluded(v.Path(), excludes)
+		if err != nil {
+			return nil, err
+		}
+		if !excluded {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered, nil
+}
+
+func isGlob(expr string) bool {
+	return strings.ContainsAny(expr, "*?") || cue.ParsePath(expr).Err() != nil
+}
+
+// segment is a component of a glob selector, quoted segments are always
+// matched literally.
+type segment struct {
+	pattern string
+	literal bool
+}
+
+func (s segment) match(label string) (bool, error) {
+	if s.literal {
+		return s.pattern == label, nil
+	}
+	return path.Match(s.pattern, label)
+}
+
+// splitSelector splits a selector at the dots which are not part of a
+// quoted label or a character class.
+func splitSelector(selector string) ([]segment, error) {
+	var (
+		segments []segment
+		current  strings.Builder
+		quoted   bool
+		class    bool
+	)
+
+	flush := func() error {
+		s := current.String()
+		current.Reset()
+		if s == "" {
+			return fmt.Errorf("empty segment in selector '%s'", selector)
+		}
+		if strings.HasPrefix(s, `"`) {
+			label, err := strconv.Unquote(s)
+			if err != nil {
+				return fmt.Errorf("invalid quoted segment %s in selector '%s'", s, selector)
+			}
+			segments = append(segments, segment{pattern: label, literal: true})
+			return nil
+		}
+		if _, err := path.Match(s, ""); err != nil {
+			return fmt.Errorf("invalid segment '%s' in selector '%s': %w", s, selector, err)
+		}
+		segments = append(segments, segment{pattern: s})
+		return nil
+	}
+
+	for i := 0; i < len(selector); i++ {
+		c := selector[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(selector):
+			current.WriteByte(c)
+			i++
+			c = selector[i]
+		case c == '"' && !class:
+			quoted = !quoted
+		case c == '[' && !quoted:
+			class = true
+		case c == ']' && !quoted:
+			class = false
+		case c == '.' && !quoted && !class:
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		current.WriteByte(c)
+	}
+	if quoted || class {
+		return nil, fmt.Errorf("unterminated segment in selector '%s'", selector)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+// expand returns the values of v matched by the given segments.
+func expand(v cue.Value, segments []segment) ([]cue.Value, error) {
+	if len(segments) == 0 {
+		return []cue.Value{v}, nil
+	}
+
+	var children []cue.Value
+	switch v.IncompleteKind() {
+	case cue.StructKind:
+		fields, err := v.Fields()
+		if err != nil {
+			return nil, err
+		}
+		for fields.Next() {
+			ok, err := segments[0].match(label(fields.Selector()))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				children = append(children, fields.Value())
+			}
+		}
+	case cue.ListKind:
+		items, err := v.List()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; items.Next(); i++ {
+			ok, err := segments[0].match(strconv.Itoa(i))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				children = append(children, items.Value())
+			}
+		}
+	}
+
+	var values []cue.Value
+	for _, c := range children {
+		expanded, err := expand(c, segments[1:])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, expanded...)
+	}
+	return values, nil
+}
+
+// isExcluded reports whether p is matched by, or nested beneath a path
+// matched by, any of the excludes.
+func isExcluded(p cue.Path, excludes []string) (bool, error) {
+	selectors := p.Selectors()
+	for _, e := range excludes {
+		segments, err := splitSelector(e)
+		if err != nil {
+			return false, err
+		}
+		if len(segments) > len(selectors) {
+			continue
+		}
+		matched := true
+		for i, s := range segments {
+			ok, err := s.match(label(selectors[i]))
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func label(sel cue.Selector) string {
+	switch {
+	case sel.LabelType() == cue.IndexLabel:
+		return strconv.Itoa(sel.Index())
+	case sel.LabelType() == cue.StringLabel && sel.ConstraintType() < cue.PatternConstraint:
+		return sel.Unquoted()
+	default:
+		return sel.String()
+	}
+}
@@ -0,0 +1,66 @@
+package cue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"cuelang.org/go/cue/ast"
+	cuejson "cuelang.org/go/encoding/json"
+
+	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
+)
+
+// TagVarExpr returns the CUE literal for the value of the given tag variable,
+// according to its type.
+func TagVarExpr(t cueinstancev1a1.TagVar) (ast.Expr, error) {
+	if err := ValidateTagValue(t); err != nil {
+		return nil, err
+	}
+
+	switch t.GetType() {
+	case cueinstancev1a1.StringTagVarType:
+		return ast.NewString(t.Value), nil
+	default:
+		expr, err := cuejson.Extract(t.Name, []byte(t.Value))
+		if err != nil {
+			return nil, fmt.Errorf("tag '%s': invalid %s value: %w", t.Name, t.GetType(), err)
+		}
+		return expr, nil
+	}
+}
+
+// ValidateTagValue checks that the value of the given tag variable can be
+// parsed as its type.
+func ValidateTagValue(t cueinstancev1a1.TagVar) error {
+	if t.GetType() == cueinstancev1a1.StringTagVarType {
+		return nil
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(t.Value)))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return fmt.Errorf("tag '%s': value '%s' is not a valid %s", t.Name, t.Value, t.GetType())
+	}
+
+	valid := true
+	switch t.GetType() {
+	case cueinstancev1a1.IntTagVarType:
+		n, ok := v.(json.Number)
+		valid = ok && !strings.ContainsAny(n.String(), ".eE")
+	case cueinstancev1a1.NumberTagVarType:
+		_, valid = v.(json.Number)
+	case cueinstancev1a1.BoolTagVarType:
+		_, valid = v.(bool)
+	case cueinstancev1a1.JSONTagVarType:
+	default:
+		return fmt.Errorf("tag '%s': type '%s' not supported", t.Name, t.GetType())
+	}
+
+	if !valid {
+		return fmt.Errorf("tag '%s': value '%s' is not a valid %s", t.Name, t.Value, t.GetType())
+	}
+	return nil
+}
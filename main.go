@@ -7,6 +7,7 @@ import (
 
 	flag "github.com/spf13/pflag"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
@@ -35,6 +36,7 @@ import (
 	// +kubebuilder:scaffold:imports
 	cueinstancev1a1 "github.com/akirill0v/cue-flux-controller/api/v1alpha1"
 	"github.com/akirill0v/cue-flux-controller/internal/controller"
+	"github.com/akirill0v/cue-flux-controller/internal/cue/cuem"
 	"github.com/akirill0v/cue-flux-controller/internal/features"
 )
 
@@ -70,10 +72,15 @@ func main() {
 		logOptions              logger.Options
 		aclOptions              acl.Options
 		noRemoteBases           bool
+		noClusterScopedObjects  bool
+		noCrossNamespaceObjects bool
 		leaderElectionOptions   leaderelection.Options
 		rateLimiterOptions      runtimeCtrl.RateLimiterOptions
 		watchOptions            runtimeCtrl.WatchOptions
 		defaultServiceAccount   string
+		dependencyCacheDir      string
+		dependencyCacheMaxSize  string
+		clusterName             string
 	)
 
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080",
@@ -90,8 +97,21 @@ func main() {
 		"The duration given to the reconciler to finish before forcibly stopping.")
 	flag.IntVar(&httpRetry, "http-retry", 9,
 		"The maximum number of retries when failing to fetch artifacts over HTTP.")
-	// flag.StringVar(&intkube.DefaultServiceAccountName, "default-service-account", "",
-	// 	"Default service account used for impersonation.")
+	flag.StringVar(&clusterName, "cluster-name", "",
+		"The name of the cluster, available to CUE instances as the 'cluster_name' tag variable.")
+	flag.BoolVar(&noClusterScopedObjects, "no-cluster-scoped-objects", false,
+		"Forbid the CueInstances to manage cluster-scoped objects.")
+	flag.BoolVar(&noCrossNamespaceObjects, "no-cross-namespace-objects", false,
+		"Forbid the CueInstances to manage objects outside of their namespace.")
+	flag.BoolVar(&noRemoteBases, "no-remote-bases", false,
+		"Disallow fetching remote CUE modules, the imported packages must be vendored in the cue.mod directory.")
+	flag.StringVar(&defaultServiceAccount, "default-service-account", "",
+		"Default service account used for impersonation.")
+	flag.StringVar(&dependencyCacheDir, "dependency-cache-dir", "",
+		"The directory in which the CUE module dependencies are cached, the cache is disabled when empty. "+
+			"With cuemod, only the modules pinned in 'Locked' mode are cached.")
+	flag.StringVar(&dependencyCacheMaxSize, "dependency-cache-max-size", "1Gi",
+		"The maximum size of the CUE module dependencies cache, the least recently used modules are evicted beyond it.")
 
 	clientOptions.BindFlags(flag.CommandLine)
 	logOptions.BindFlags(flag.CommandLine)
@@ -193,17 +213,35 @@ func main() {
 		pollingOpts.ClusterReaderFactory = engine.ClusterReaderFactoryFunc(clusterreader.NewDirectClusterReader)
 	}
 
+	var dependencyCache *cuem.Cache
+	if dependencyCacheDir != "" {
+		maxSize, err := resource.ParseQuantity(dependencyCacheMaxSize)
+		if err != nil {
+			setupLog.Error(err, "invalid dependency cache max size")
+			os.Exit(1)
+		}
+		dependencyCache, err = cuem.NewCache(dependencyCacheDir, maxSize.Value())
+		if err != nil {
+			setupLog.Error(err, "unable to create the dependency cache")
+			os.Exit(1)
+		}
+	}
+
 	if err = (&controller.CueInstanceReconciler{
-		ControllerName:        controllerName,
-		DefaultServiceAccount: defaultServiceAccount,
-		Client:                mgr.GetClient(),
-		Metrics:               metricsH,
-		EventRecorder:         eventRecorder,
-		NoCrossNamespaceRefs:  aclOptions.NoCrossNamespaceRefs,
-		NoRemoteBases:         noRemoteBases,
-		KubeConfigOpts:        kubeConfigOpts,
-		PollingOpts:           pollingOpts,
-		StatusPoller:          polling.NewStatusPoller(mgr.GetClient(), mgr.GetRESTMapper(), pollingOpts),
+		ControllerName:          controllerName,
+		DefaultServiceAccount:   defaultServiceAccount,
+		ClusterName:             clusterName,
+		Client:                  mgr.GetClient(),
+		Metrics:                 metricsH,
+		EventRecorder:           eventRecorder,
+		NoCrossNamespaceRefs:    aclOptions.NoCrossNamespaceRefs,
+		NoRemoteBases:           noRemoteBases,
+		NoClusterScopedObjects:  noClusterScopedObjects,
+		NoCrossNamespaceObjects: noCrossNamespaceObjects,
+		KubeConfigOpts:          kubeConfigOpts,
+		DependencyCache:         dependencyCache,
+		PollingOpts:             pollingOpts,
+		StatusPoller:            polling.NewStatusPoller(mgr.GetClient(), mgr.GetRESTMapper(), pollingOpts),
 	}).SetupWithManager(ctx, mgr, controller.CueInstanceReconcilerOptions{
 		DependencyRequeueInterval: requeueDependency,
 		HTTPRetry:                 httpRetry,